@@ -0,0 +1,125 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// address types of SOCKS address
+const (
+	AddrTypeIPv4   = 1
+	AddrTypeDomain = 3
+	AddrTypeIPv6   = 4
+)
+
+// AddrMaxSize maximum size of a SOCKS address, 1 + 1 + 255 + 2
+const AddrMaxSize = 259
+
+// ErrBadAddr address is mal-formatted
+var ErrBadAddr = errors.New("bad address")
+
+// Addr a SOCKS address (ATYP | ADDR | PORT), sent before payload as target address
+type Addr []byte
+
+// ParseAddr parse a host:port string to Addr
+func ParseAddr(s string) (Addr, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, ErrBadAddr
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, ErrBadAddr
+	}
+
+	var a Addr
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			a = append(Addr{AddrTypeIPv4}, ip4...)
+		} else {
+			a = append(Addr{AddrTypeIPv6}, ip...)
+		}
+	} else {
+		if len(host) == 0 || len(host) > 255 {
+			return nil, ErrBadAddr
+		}
+		a = append(Addr{AddrTypeDomain, byte(len(host))}, host...)
+	}
+	return append(a, byte(port>>8), byte(port)), nil
+}
+
+// addrSize returns size of Addr by the first bytes, 0 if more bytes needed to decide
+func addrSize(b []byte) (int, error) {
+	if len(b) < 1 {
+		return 0, nil
+	}
+	switch b[0] {
+	case AddrTypeIPv4:
+		return 1 + net.IPv4len + 2, nil
+	case AddrTypeIPv6:
+		return 1 + net.IPv6len + 2, nil
+	case AddrTypeDomain:
+		if len(b) < 2 {
+			return 0, nil
+		}
+		return 1 + 1 + int(b[1]) + 2, nil
+	}
+	return 0, ErrBadAddr
+}
+
+// ReadAddr read a Addr from io.Reader
+func ReadAddr(r io.Reader) (Addr, error) {
+	b := make([]byte, AddrMaxSize)
+	// type and possible domain length
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return nil, err
+	}
+	n, err := addrSize(b[:2])
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(r, b[2:n]); err != nil {
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+// SplitAddr split a Addr from the beginning of bytes
+func SplitAddr(b []byte) (Addr, error) {
+	n, err := addrSize(b)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || len(b) < n {
+		return nil, ErrBadAddr
+	}
+	return b[:n], nil
+}
+
+// Host returns host of Addr, either IP or domain
+func (a Addr) Host() string {
+	switch a[0] {
+	case AddrTypeIPv4:
+		return net.IP(a[1 : 1+net.IPv4len]).String()
+	case AddrTypeIPv6:
+		return net.IP(a[1 : 1+net.IPv6len]).String()
+	}
+	return string(a[2 : 2+int(a[1])])
+}
+
+// Port returns port of Addr
+func (a Addr) Port() int {
+	return int(a[len(a)-2])<<8 | int(a[len(a)-1])
+}
+
+// String returns host:port
+func (a Addr) String() string {
+	return net.JoinHostPort(a.Host(), strconv.Itoa(a.Port()))
+}
+
+// Network for net.Addr
+func (a Addr) Network() string {
+	return "socks"
+}
@@ -0,0 +1,41 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAddr(t *testing.T) {
+	for _, s := range []string{"127.0.0.1:80", "[::1]:443", "example.com:8080"} {
+		a, err := ParseAddr(s)
+		if err != nil {
+			t.Fatalf("%v: Failed to parse; error: %v", s, err)
+		}
+		if a.String() != s {
+			t.Fatalf("%v: String mismatch: %v", s, a.String())
+		}
+		b, err := ReadAddr(bytes.NewReader(append(a, "payload"...)))
+		if err != nil || !bytes.Equal(a, b) {
+			t.Fatalf("%v: Failed to read; error: %v", s, err)
+		}
+		b, err = SplitAddr(append(a, "payload"...))
+		if err != nil || !bytes.Equal(a, b) {
+			t.Fatalf("%v: Failed to split; error: %v", s, err)
+		}
+	}
+	a, _ := ParseAddr("127.0.0.1:80")
+	if !bytes.Equal(a, []byte{AddrTypeIPv4, 127, 0, 0, 1, 0, 80}) {
+		t.Fatalf("Bad encoding: %v", a)
+	}
+	for _, s := range []string{"127.0.0.1", "example.com:http", ":80"} {
+		if _, err := ParseAddr(s); err != ErrBadAddr {
+			t.Fatalf("%v: should fail", s)
+		}
+	}
+	if _, err := SplitAddr([]byte{AddrTypeDomain, 10, 'a'}); err != ErrBadAddr {
+		t.Fatal("should fail on short address")
+	}
+	if _, err := SplitAddr([]byte{9, 1, 2}); err != ErrBadAddr {
+		t.Fatal("should fail on bad address type")
+	}
+}
@@ -5,11 +5,18 @@ import (
 	"crypto/cipher"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"golang.org/x/crypto/blake2b"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/hkdf"
+	"golang.org/x/sys/cpu"
+	"hash"
 	"io"
 	"log"
 	"strconv"
+	"strings"
 )
 
 // CipherDescriptor describes ciphers
@@ -25,7 +32,13 @@ var (
 		"AEAD_AES_128_GCM",
 		"AEAD_AES_192_GCM",
 		"AEAD_AES_256_GCM",
+		"AEAD_AES_128_GCM_SIV",
+		"AEAD_AES_256_GCM_SIV",
 		"AEAD_DUMMY",
+		"FLEE_X25519_CHACHA20_POLY1305",
+		"FLEE_X25519_AES_256_GCM",
+		"FLEE_X25519_MLKEM768_CHACHA20_POLY1305",
+		"FLEE_X25519_MLKEM768_AES_256_GCM",
 	}
 	// SupportedCiphers array of supported ciphers
 	SupportedCiphers = map[string]*CipherDescriptor{
@@ -45,13 +58,59 @@ var (
 			KeySize:       32,
 			CipherFactory: NewAESGCMCipher,
 		},
+		"AEAD_AES_128_GCM_SIV": {
+			KeySize:       16,
+			CipherFactory: NewAESGCMSIVCipher,
+		},
+		"AEAD_AES_256_GCM_SIV": {
+			KeySize:       32,
+			CipherFactory: NewAESGCMSIVCipher,
+		},
 		"AEAD_DUMMY": {
 			KeySize:       32,
 			CipherFactory: NewDummyCipher,
 		},
+		"FLEE_X25519_CHACHA20_POLY1305": {
+			KeySize:       32,
+			CipherFactory: NewX25519ChapoCipher,
+		},
+		"FLEE_X25519_AES_256_GCM": {
+			KeySize:       32,
+			CipherFactory: NewX25519AESGCMCipher,
+		},
+		"FLEE_X25519_MLKEM768_CHACHA20_POLY1305": {
+			KeySize:       32,
+			CipherFactory: NewX25519MLKEMChapoCipher,
+		},
+		"FLEE_X25519_MLKEM768_AES_256_GCM": {
+			KeySize:       32,
+			CipherFactory: NewX25519MLKEMAESGCMCipher,
+		},
 	}
 )
 
+// CipherAuto selects PreferredCipher for clients, and accepts all of AutoCipherNames for servers
+const CipherAuto = "AUTO"
+
+// AutoCipherNames ciphers PreferredCipher chooses from
+var AutoCipherNames = []string{
+	"AEAD_AES_256_GCM",
+	"AEAD_CHACHA20_POLY1305",
+}
+
+// hasAESGCM reports if CPU accelerates both AES and GHASH
+var hasAESGCM = cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ ||
+	cpu.ARM64.HasAES && cpu.ARM64.HasPMULL ||
+	cpu.S390X.HasAES && cpu.S390X.HasAESGCM
+
+// PreferredCipher returns AEAD_AES_256_GCM if CPU accelerates AES-GCM, AEAD_CHACHA20_POLY1305 otherwise
+func PreferredCipher() string {
+	if hasAESGCM {
+		return AutoCipherNames[0]
+	}
+	return AutoCipherNames[1]
+}
+
 // BadKeyLengthError error when key length is bad
 type BadKeyLengthError int
 
@@ -62,6 +121,112 @@ func (e BadKeyLengthError) Error() string {
 // HKDFInfo pre-defined HKDF info
 var HKDFInfo = []byte("ss-subkey")
 
+// ErrHKDFNotSupported cipher does not support custom HKDF
+var ErrHKDFNotSupported = errors.New("cipher does not support custom HKDF")
+
+// ErrServerKeyNotSupported cipher does not support static key of server
+var ErrServerKeyNotSupported = errors.New("cipher does not support server key")
+
+// ErrCipherDestroyed cipher is used after Destroy
+var ErrCipherDestroyed = errors.New("cipher is destroyed")
+
+var (
+	// SupportedHKDFHashNames names of supported HKDF hash functions
+	SupportedHKDFHashNames = []string{
+		"SHA1",
+		"SHA256",
+		"SHA512",
+		"BLAKE2B_256",
+		"BLAKE2B_512",
+	}
+	// SupportedHKDFHashes hash functions by name
+	SupportedHKDFHashes = map[string]func() hash.Hash{
+		"SHA1":   sha1.New,
+		"SHA256": sha256.New,
+		"SHA512": sha512.New,
+		"BLAKE2B_256": func() hash.Hash {
+			h, _ := blake2b.New256(nil)
+			return h
+		},
+		"BLAKE2B_512": func() hash.Hash {
+			h, _ := blake2b.New512(nil)
+			return h
+		},
+	}
+)
+
+// HKDF describes the hash function and info used to derive subkeys
+type HKDF struct {
+	// hash function, default to SHA1
+	Hash func() hash.Hash
+	// info, default to HKDFInfo
+	Info []byte
+}
+
+// NewHKDF create a HKDF with hash name and info, empty values fall back to defaults
+func NewHKDF(hashName string, info []byte) (*HKDF, error) {
+	k := &HKDF{Info: info}
+	if len(hashName) > 0 {
+		name, ok := ResolveHKDFHashName(hashName)
+		if !ok {
+			return nil, ErrBadHKDFHash
+		}
+		k.Hash = SupportedHKDFHashes[name]
+	}
+	return k, nil
+}
+
+// DeriveSubkey expand master key with this HKDF, nil HKDF behaves like DeriveSubkey
+func (k *HKDF) DeriveSubkey(master, salt, out []byte) {
+	if k == nil {
+		DeriveSubkey(master, salt, out)
+		return
+	}
+	h, info := k.Hash, k.Info
+	if h == nil {
+		h = sha1.New
+	}
+	if info == nil {
+		info = HKDFInfo
+	}
+	r := hkdf.New(h, master, salt, info)
+	_, err := io.ReadFull(r, out)
+	if err != nil {
+		// should never happened
+		log.Fatal(err)
+	}
+}
+
+// ResolveHKDFHashName resolve hash name aliases and check if hash is supported
+func ResolveHKDFHashName(name string) (string, bool) {
+	d := strings.ToUpper(name)
+	d = strings.Replace(d, "-", "_", -1)
+	for _, s := range SupportedHKDFHashNames {
+		if s == d {
+			return d, true
+		}
+	}
+	// "BLAKE2B" is BLAKE2B_512
+	if d == "BLAKE2B" {
+		return "BLAKE2B_512", true
+	}
+	// "SHA_256" and alike
+	d = strings.Replace(d, "_", "", -1)
+	for _, s := range SupportedHKDFHashNames {
+		if s == d {
+			return d, true
+		}
+	}
+	return "", false
+}
+
+// HKDFCipher is implemented by ciphers with customizable subkey derivation
+type HKDFCipher interface {
+	Cipher
+	// create a copy of cipher using given HKDF
+	WithHKDF(k *HKDF) Cipher
+}
+
 // Cipher represents a AEAD cipher
 type Cipher interface {
 	// size of key
@@ -74,20 +239,78 @@ type Cipher interface {
 	CreateAEAD(salt []byte) (cipher.AEAD, error)
 }
 
+// DestroyableCipher is implemented by ciphers holding key material
+type DestroyableCipher interface {
+	Cipher
+	// zero master key, and release locked memory of it, see LockKeyMemory
+	// CreateAEAD fails with ErrCipherDestroyed afterwards, AEADs created before are not affected
+	// safe while the cipher is still in use, it waits for subkey derivations in progress
+	Destroy()
+}
+
+// DestroyCipher destroys c if it is a DestroyableCipher
+func DestroyCipher(c Cipher) {
+	if dc, ok := c.(DestroyableCipher); ok {
+		dc.Destroy()
+	}
+}
+
+// cloneableCipher copies itself with its own copy of key
+type cloneableCipher interface {
+	clone() Cipher
+}
+
+// cloneCipher copies c if supported, so the copy and c can be destroyed separately
+func cloneCipher(c Cipher) Cipher {
+	if cc, ok := c.(cloneableCipher); ok {
+		return cc.clone()
+	}
+	return c
+}
+
 // NewCipher create a new Cipher with name and password
+// master key is locked in memory if LockKeyMemory is set, and released by DestroyCipher
 func NewCipher(name, password string) (Cipher, error) {
 	desc := SupportedCiphers[name]
 	if desc == nil {
 		// not possible, config.go should handled it
 		log.Fatal("Cipher " + name + " is not supported")
 	}
-	key := DeriveMasterKey(password, desc.KeySize)
-	return desc.CipherFactory(key, desc.KeySize)
+	derived := DeriveMasterKey(password, desc.KeySize)
+	key := newKey(desc.KeySize)
+	copy(key, derived)
+	zeroBytes(derived)
+	c, err := desc.CipherFactory(key, desc.KeySize)
+	if err != nil {
+		destroyKey(key)
+	}
+	return c, err
+}
+
+// NewCipherWithHKDF create a new Cipher with name and password, using HKDF for subkey derivation
+func NewCipherWithHKDF(name, password string, k *HKDF) (Cipher, error) {
+	c, err := NewCipher(name, password)
+	if err != nil {
+		return nil, err
+	}
+	if k == nil {
+		return c, nil
+	}
+	hc, ok := c.(HKDFCipher)
+	if !ok {
+		DestroyCipher(c)
+		return nil, ErrHKDFNotSupported
+	}
+	// the derived cipher has its own copy of key
+	defer DestroyCipher(c)
+	return hc.WithHKDF(k), nil
 }
 
 // DeriveMasterKey derive master key from password string
 func DeriveMasterKey(password string, keyLen int) []byte {
-	var b, prev []byte
+	// preallocated, so growing leaves no copies of key behind
+	b := make([]byte, 0, (keyLen/md5.Size+1)*md5.Size)
+	var prev []byte
 	h := md5.New()
 	for len(b) < keyLen {
 		h.Write(prev)
@@ -111,7 +334,8 @@ func DeriveSubkey(master, salt, out []byte) {
 
 // ChapoCipher is for ChaCha20-Poly1305
 type ChapoCipher struct {
-	key []byte
+	key  *masterKey
+	hkdf *HKDF
 }
 
 // NewChapoCipher create a new ChapoCipher base on a key string
@@ -119,7 +343,7 @@ func NewChapoCipher(key []byte, size int) (Cipher, error) {
 	if size != chacha20poly1305.KeySize {
 		log.Fatalf("keySize of chacha20-poly1305 should be fixed %v\n", chacha20poly1305.KeySize)
 	}
-	return &ChapoCipher{key: key}, nil
+	return &ChapoCipher{key: &masterKey{b: key}}, nil
 }
 
 // KeySize for ChaCha20-Poly1305
@@ -137,23 +361,41 @@ func (c *ChapoCipher) NonceSize() int {
 	return chacha20poly1305.NonceSize
 }
 
+// WithHKDF for ChaCha20-Poly1305
+func (c *ChapoCipher) WithHKDF(k *HKDF) Cipher {
+	return &ChapoCipher{key: c.key.copy(), hkdf: k}
+}
+
+func (c *ChapoCipher) clone() Cipher {
+	return c.WithHKDF(c.hkdf)
+}
+
+// Destroy for ChaCha20-Poly1305
+func (c *ChapoCipher) Destroy() {
+	c.key.destroy()
+}
+
 // CreateAEAD for ChaCha20-Poly1305
 func (c *ChapoCipher) CreateAEAD(salt []byte) (cipher.AEAD, error) {
 	subkey := make([]byte, c.KeySize())
-	DeriveSubkey(c.key, salt, subkey)
+	defer zeroBytes(subkey)
+	if err := c.key.derive(c.hkdf, salt, subkey); err != nil {
+		return nil, err
+	}
 	return chacha20poly1305.New(subkey)
 }
 
 // AESGCMCipher is for AES_XXX_GCM
 type AESGCMCipher struct {
-	key  []byte
+	key  *masterKey
 	size int
+	hkdf *HKDF
 }
 
 // NewAESGCMCipher create a new AES_XXX_GCM cipher
 // one of 16, 24, or 32 to select AES-128/196/256-GCM.
 func NewAESGCMCipher(key []byte, size int) (Cipher, error) {
-	return &AESGCMCipher{key: key, size: size}, nil
+	return &AESGCMCipher{key: &masterKey{b: key}, size: size}, nil
 }
 
 // KeySize for AES-GCM
@@ -171,10 +413,27 @@ func (c *AESGCMCipher) NonceSize() int {
 	return 12
 }
 
+// WithHKDF for AES-GCM
+func (c *AESGCMCipher) WithHKDF(k *HKDF) Cipher {
+	return &AESGCMCipher{key: c.key.copy(), size: c.size, hkdf: k}
+}
+
+func (c *AESGCMCipher) clone() Cipher {
+	return c.WithHKDF(c.hkdf)
+}
+
+// Destroy for AES-GCM
+func (c *AESGCMCipher) Destroy() {
+	c.key.destroy()
+}
+
 // CreateAEAD for AESGCM
 func (c *AESGCMCipher) CreateAEAD(salt []byte) (cipher.AEAD, error) {
 	subkey := make([]byte, c.KeySize())
-	DeriveSubkey(c.key, salt, subkey)
+	defer zeroBytes(subkey)
+	if err := c.key.derive(c.hkdf, salt, subkey); err != nil {
+		return nil, err
+	}
 	blk, err := aes.NewCipher(subkey)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,231 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrEmptyChain proxy chain has no server
+var ErrEmptyChain = errors.New("proxy chain is empty")
+
+// ProxyDialer dials targets, through a FleeGrid server or not
+type ProxyDialer interface {
+	// dial a TCP target
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	// create a net.PacketConn sending to and receiving from UDP targets
+	ListenPacket(ctx context.Context) (net.PacketConn, error)
+}
+
+// Dialer dials targets through a FleeGrid server
+type Dialer struct {
+	// address of FleeGrid server
+	Address string
+	// cipher of FleeGrid server
+	Cipher Cipher
+	// timeout for connecting FleeGrid server
+	Timeout time.Duration
+	// TCP keepalive period of connections to FleeGrid server, 0 keeps system default
+	KeepAlive time.Duration
+	// interval of keepalive records if nothing written, 0 disables, see StreamConn.SetKeepAliveRecords
+	KeepAliveRecords time.Duration
+	// closes connections without traffic for timeout, 0 disables
+	IdleTimeout time.Duration
+	// sends UDP packets in sessions, the server must support session packets
+	PacketSession bool
+	// dialer for connecting FleeGrid server, connects directly if nil
+	// a *Dialer of another FleeGrid server makes a proxy chain
+	Upstream ProxyDialer
+}
+
+// NewDialer create a new Dialer from Config
+func NewDialer(config *Config) (*Dialer, error) {
+	c, err := config.NewCipher()
+	if err != nil {
+		return nil, err
+	}
+	return &Dialer{Address: config.Address, Cipher: c, PacketSession: config.PacketSession}, nil
+}
+
+// NewChainDialer create a Dialer through FleeGrid servers of Configs in order
+// the first Config is connected directly, the last Config connects targets
+func NewChainDialer(configs ...*Config) (*Dialer, error) {
+	if len(configs) == 0 {
+		return nil, ErrEmptyChain
+	}
+	var d *Dialer
+	for _, config := range configs {
+		next, err := NewDialer(config)
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			next.Upstream = d
+		}
+		d = next
+	}
+	return d, nil
+}
+
+// NewChainDialerFromURLs create a Dialer through FleeGrid servers of flee:// URLs in order, see NewChainDialer
+func NewChainDialerFromURLs(urls ...string) (*Dialer, error) {
+	configs := make([]*Config, len(urls))
+	for i, u := range urls {
+		config, err := ParseConfigFromURL(u)
+		if err != nil {
+			return nil, err
+		}
+		configs[i] = config
+	}
+	return NewChainDialer(configs...)
+}
+
+// Destroy destroys ciphers of Dialer and its upstream Dialers, see DestroyCipher
+// should be called when a Dialer is replaced, like on config reload
+func (d *Dialer) Destroy() {
+	DestroyCipher(d.Cipher)
+	if u, ok := d.Upstream.(*Dialer); ok {
+		u.Destroy()
+	}
+}
+
+// Dial see DialContext
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects FleeGrid server and sends target address, only TCP is supported
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	target, err := ParseAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.dialServer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sconn := NewStreamConn(conn, d.Cipher)
+	if d.KeepAlive > 0 {
+		sconn.SetKeepAlive(d.KeepAlive)
+	}
+	sconn.SetKeepAliveRecords(d.KeepAliveRecords)
+	sconn.SetIdleTimeout(d.IdleTimeout)
+	if _, err = sconn.Write(target); err != nil {
+		sconn.Close()
+		return nil, err
+	}
+	return sconn, nil
+}
+
+// dialServer connects FleeGrid server, through Upstream if not nil
+func (d *Dialer) dialServer(ctx context.Context) (net.Conn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	if d.Upstream != nil {
+		return d.Upstream.DialContext(ctx, "tcp", d.Address)
+	}
+	var nd net.Dialer
+	return nd.DialContext(ctx, "tcp", d.Address)
+}
+
+// ListenPacket creates a ProxyPacketConn sending packets to targets through FleeGrid server
+// through Upstream, address of FleeGrid server is sent as is, and resolved by upstream server
+func (d *Dialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	var server net.Addr
+	var pc net.PacketConn
+	var err error
+	if d.Upstream != nil {
+		if server, err = ParseAddr(d.Address); err != nil {
+			return nil, err
+		}
+		pc, err = d.Upstream.ListenPacket(ctx)
+	} else {
+		if server, err = net.ResolveUDPAddr("udp", d.Address); err != nil {
+			return nil, err
+		}
+		var lc net.ListenConfig
+		pc, err = lc.ListenPacket(ctx, "udp", "")
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn, err := NewPacketConn(pc, d.Cipher)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	conn.SetPacketSession(d.PacketSession)
+	return &ProxyPacketConn{PacketConn: conn, server: server, buf: make([]byte, PacketMaxSize)}, nil
+}
+
+// ProxyPacketConn sends packets to targets through a FleeGrid server
+// WriteTo accepts any net.Addr with host:port String(), ReadFrom returns Addr of source
+type ProxyPacketConn struct {
+	net.PacketConn
+	server net.Addr
+	buf    []byte
+	lock   sync.Mutex
+}
+
+// WriteTo prepends target address and sends to FleeGrid server
+func (c *ProxyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	target, ok := addr.(Addr)
+	if !ok {
+		var err error
+		if target, err = ParseAddr(addr.String()); err != nil {
+			return 0, err
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(target)+len(b) > len(c.buf) {
+		return 0, ErrPacketTooLarge
+	}
+	n := copy(c.buf, target)
+	n += copy(c.buf[n:], b)
+	if _, err := c.PacketConn.WriteTo(c.buf[:n], c.server); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom reads a packet from FleeGrid server, returns payload and source address
+func (c *ProxyPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return 0, nil, err
+		}
+		// ignore packets not from FleeGrid server
+		if !c.fromServer(addr) {
+			continue
+		}
+		src, err := SplitAddr(b[:n])
+		if err != nil {
+			return 0, nil, err
+		}
+		src = append(Addr(nil), src...)
+		return copy(b, b[len(src):n]), src, nil
+	}
+}
+
+// fromServer reports whether addr is of FleeGrid server
+// a server of domain name is resolved by upstream server, only its port is compared
+func (c *ProxyPacketConn) fromServer(addr net.Addr) bool {
+	if a, ok := c.server.(Addr); ok && a[0] == AddrTypeDomain {
+		_, port, err := net.SplitHostPort(addr.String())
+		return err == nil && port == strconv.Itoa(a.Port())
+	}
+	return addr.String() == c.server.String()
+}
@@ -56,3 +56,8 @@ func (d *DummyCipher) NonceSize() int {
 func (d *DummyCipher) CreateAEAD(salt []byte) (cipher.AEAD, error) {
 	return &dummyAEAD{}, nil
 }
+
+// WithHKDF for DummyCipher, no subkey is derived so HKDF is ignored
+func (d *DummyCipher) WithHKDF(k *HKDF) Cipher {
+	return d
+}
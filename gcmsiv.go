@@ -0,0 +1,263 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// ErrGCMSIVOpen message authentication failed
+var ErrGCMSIVOpen = errors.New("gcmsiv: message authentication failed")
+
+// gcmSIV is AES-GCM-SIV, see RFC 8452
+// it is nonce-misuse-resistant, reusing a nonce only reveals whether the same message is encrypted
+type gcmSIV struct {
+	// key-generating key
+	block   cipher.Block
+	keySize int
+}
+
+// NewGCMSIV create a AES-GCM-SIV AEAD with 16 or 32 bytes key
+func NewGCMSIV(key []byte) (cipher.AEAD, error) {
+	if len(key) != 16 && len(key) != 32 {
+		return nil, BadKeyLengthError(len(key))
+	}
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmSIV{block: blk, keySize: len(key)}, nil
+}
+
+func (g *gcmSIV) NonceSize() int {
+	return 12
+}
+
+func (g *gcmSIV) Overhead() int {
+	return 16
+}
+
+// deriveKeys derives message authentication key and message encryption key from nonce
+func (g *gcmSIV) deriveKeys(nonce []byte) ([]byte, cipher.Block) {
+	var in, out [16]byte
+	copy(in[4:], nonce)
+	keys := make([]byte, 16+g.keySize)
+	for i := 0; i < len(keys)/8; i++ {
+		binary.LittleEndian.PutUint32(in[:4], uint32(i))
+		g.block.Encrypt(out[:], in[:])
+		copy(keys[i*8:], out[:8])
+	}
+	zeroBytes(out[:])
+	// key size is valid
+	blk, _ := aes.NewCipher(keys[16:])
+	zeroBytes(keys[16:])
+	return keys[:16], blk
+}
+
+// tag computes tag of plaintext and additional data
+func (g *gcmSIV) tag(authKey []byte, blk cipher.Block, nonce, plaintext, data []byte) [16]byte {
+	var p polyval
+	p.init(authKey)
+	p.update(data)
+	p.update(plaintext)
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[:8], uint64(len(data))*8)
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(plaintext))*8)
+	p.update(lengths[:])
+
+	s := p.sum()
+	for i := range nonce {
+		s[i] ^= nonce[i]
+	}
+	s[15] &= 0x7f
+	blk.Encrypt(s[:], s[:])
+	return s
+}
+
+// ctr encrypts or decrypts in with counter derived from tag
+func (g *gcmSIV) ctr(blk cipher.Block, tag [16]byte, out, in []byte) {
+	counter := tag
+	counter[15] |= 0x80
+	var ks [16]byte
+	for len(in) > 0 {
+		blk.Encrypt(ks[:], counter[:])
+		// 32-bit little-endian counter wraps
+		binary.LittleEndian.PutUint32(counter[:4], binary.LittleEndian.Uint32(counter[:4])+1)
+		n := subtle.XORBytes(out, in, ks[:])
+		out, in = out[n:], in[n:]
+	}
+}
+
+func (g *gcmSIV) Seal(dst, nonce, plaintext, data []byte) []byte {
+	if len(nonce) != g.NonceSize() {
+		panic("gcmsiv: incorrect nonce length")
+	}
+	authKey, blk := g.deriveKeys(nonce)
+	defer zeroBytes(authKey)
+	tag := g.tag(authKey, blk, nonce, plaintext, data)
+	ret, out := sliceForAppend(dst, len(plaintext)+16)
+	g.ctr(blk, tag, out, plaintext)
+	copy(out[len(plaintext):], tag[:])
+	return ret
+}
+
+func (g *gcmSIV) Open(dst, nonce, ciphertext, data []byte) ([]byte, error) {
+	if len(nonce) != g.NonceSize() {
+		panic("gcmsiv: incorrect nonce length")
+	}
+	if len(ciphertext) < 16 {
+		return nil, ErrGCMSIVOpen
+	}
+	var tag [16]byte
+	n := len(ciphertext) - 16
+	copy(tag[:], ciphertext[n:])
+	authKey, blk := g.deriveKeys(nonce)
+	defer zeroBytes(authKey)
+	ret, out := sliceForAppend(dst, n)
+	g.ctr(blk, tag, out, ciphertext[:n])
+	expected := g.tag(authKey, blk, nonce, out, data)
+	if subtle.ConstantTimeCompare(expected[:], tag[:]) != 1 {
+		zeroBytes(out)
+		return nil, ErrGCMSIVOpen
+	}
+	return ret, nil
+}
+
+// sliceForAppend extends in by n bytes, returns the whole slice and the extension
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
+
+// polyval is the universal hash of AES-GCM-SIV, over GF(2^128) with x^128 + x^127 + x^126 + x^121 + 1
+// field elements are little-endian, multiplication is constant time
+type polyval struct {
+	h0, h1 uint64
+	s0, s1 uint64
+}
+
+func (p *polyval) init(key []byte) {
+	p.h0, p.h1 = binary.LittleEndian.Uint64(key[:8]), binary.LittleEndian.Uint64(key[8:])
+	p.s0, p.s1 = 0, 0
+}
+
+// update absorbs b, the last partial block is padded with zeros
+func (p *polyval) update(b []byte) {
+	var block [16]byte
+	for len(b) > 0 {
+		n := copy(block[:], b)
+		for i := n; i < 16; i++ {
+			block[i] = 0
+		}
+		b = b[n:]
+		p.s0 ^= binary.LittleEndian.Uint64(block[:8])
+		p.s1 ^= binary.LittleEndian.Uint64(block[8:])
+		p.s0, p.s1 = polyvalDot(p.s0, p.s1, p.h0, p.h1)
+	}
+}
+
+func (p *polyval) sum() [16]byte {
+	var s [16]byte
+	binary.LittleEndian.PutUint64(s[:8], p.s0)
+	binary.LittleEndian.PutUint64(s[8:], p.s1)
+	return s
+}
+
+// polyvalDot returns a * b * x^-128
+func polyvalDot(a0, a1, b0, b1 uint64) (uint64, uint64) {
+	l1, l0 := clmul(a0, b0)
+	h1, h0 := clmul(a1, b1)
+	m1, m0 := clmul(a0, b1)
+	n1, n0 := clmul(a1, b0)
+	c0, c1, c2, c3 := l0, l1^m0^n0, h0^m1^n1, h1
+
+	// add multiples of the polynomial to clear lower 128 bits, then divide by x^128
+	c1 ^= c0<<63 ^ c0<<62 ^ c0<<57
+	c2 ^= c0 ^ c0>>1 ^ c0>>2 ^ c0>>7
+	c2 ^= c1<<63 ^ c1<<62 ^ c1<<57
+	c3 ^= c1 ^ c1>>1 ^ c1>>2 ^ c1>>7
+	return c2, c3
+}
+
+// clmul returns carry-less product of x and y, in constant time
+func clmul(x, y uint64) (hi, lo uint64) {
+	lo = bmul64(x, y)
+	hi = bits.Reverse64(bmul64(bits.Reverse64(x), bits.Reverse64(y))) >> 1
+	return
+}
+
+// bmul64 returns lower 64 bits of carry-less product, integer multiplications with holes avoid carries
+func bmul64(x, y uint64) uint64 {
+	const m0, m1, m2, m3 = 0x1111111111111111, 0x2222222222222222, 0x4444444444444444, 0x8888888888888888
+	x0, x1, x2, x3 := x&m0, x&m1, x&m2, x&m3
+	y0, y1, y2, y3 := y&m0, y&m1, y&m2, y&m3
+	z0 := (x0 * y0) ^ (x1 * y3) ^ (x2 * y2) ^ (x3 * y1)
+	z1 := (x0 * y1) ^ (x1 * y0) ^ (x2 * y3) ^ (x3 * y2)
+	z2 := (x0 * y2) ^ (x1 * y1) ^ (x2 * y0) ^ (x3 * y3)
+	z3 := (x0 * y3) ^ (x1 * y2) ^ (x2 * y1) ^ (x3 * y0)
+	return z0&m0 | z1&m1 | z2&m2 | z3&m3
+}
+
+// AESGCMSIVCipher is for AES_XXX_GCM_SIV, nonce-misuse-resistant
+// with the packet protocol, a repeated salt only reveals whether the same packet is sent
+type AESGCMSIVCipher struct {
+	key  *masterKey
+	size int
+	hkdf *HKDF
+}
+
+// NewAESGCMSIVCipher create a new AES_XXX_GCM_SIV cipher, size is 16 or 32
+func NewAESGCMSIVCipher(key []byte, size int) (Cipher, error) {
+	if size != 16 && size != 32 {
+		return nil, BadKeyLengthError(size)
+	}
+	return &AESGCMSIVCipher{key: &masterKey{b: key}, size: size}, nil
+}
+
+// KeySize for AES-GCM-SIV
+func (c *AESGCMSIVCipher) KeySize() int {
+	return c.size
+}
+
+// SaltSize for AES-GCM-SIV
+func (c *AESGCMSIVCipher) SaltSize() int {
+	return c.size
+}
+
+// NonceSize for AES-GCM-SIV
+func (c *AESGCMSIVCipher) NonceSize() int {
+	return 12
+}
+
+// WithHKDF for AES-GCM-SIV
+func (c *AESGCMSIVCipher) WithHKDF(k *HKDF) Cipher {
+	return &AESGCMSIVCipher{key: c.key.copy(), size: c.size, hkdf: k}
+}
+
+func (c *AESGCMSIVCipher) clone() Cipher {
+	return c.WithHKDF(c.hkdf)
+}
+
+// Destroy for AES-GCM-SIV
+func (c *AESGCMSIVCipher) Destroy() {
+	c.key.destroy()
+}
+
+// CreateAEAD for AES-GCM-SIV
+func (c *AESGCMSIVCipher) CreateAEAD(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, c.KeySize())
+	defer zeroBytes(subkey)
+	if err := c.key.derive(c.hkdf, salt, subkey); err != nil {
+		return nil, err
+	}
+	return NewGCMSIV(subkey)
+}
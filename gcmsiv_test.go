@@ -0,0 +1,115 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestPolyval(t *testing.T) {
+	// RFC 8452, Appendix A
+	key, _ := hex.DecodeString("25629347589242761d31f826ba4b757b")
+	x, _ := hex.DecodeString("4f4f95668c83dfb6401762bb2d01a262d1a24ddd2721d006bbe45f20d3c9f362")
+	var p polyval
+	p.init(key)
+	p.update(x)
+	s := p.sum()
+	if hex.EncodeToString(s[:]) != "f7a3b47b846119fae5b7866cf5e5b77e" {
+		t.Fatalf("POLYVAL mismatch: %x", s)
+	}
+}
+
+func TestGCMSIVVectors(t *testing.T) {
+	// RFC 8452, Appendix C
+	for _, v := range []struct {
+		key, nonce, plain, data, result string
+	}{
+		{
+			"01000000000000000000000000000000",
+			"030000000000000000000000",
+			"",
+			"",
+			"dc20e2d83f25705bb49e439eca56de25",
+		},
+		{
+			"01000000000000000000000000000000",
+			"030000000000000000000000",
+			"0100000000000000",
+			"",
+			"b5d839330ac7b786578782fff6013b815b287c22493a364c",
+		},
+		{
+			"0100000000000000000000000000000000000000000000000000000000000000",
+			"030000000000000000000000",
+			"",
+			"",
+			"07f5f4169bbf55a8400cd47ea6fd400f",
+		},
+		{
+			"0100000000000000000000000000000000000000000000000000000000000000",
+			"030000000000000000000000",
+			"0100000000000000",
+			"",
+			"c2ef328e5c71c83b843122130f7364b761e0b97427e3df28",
+		},
+	} {
+		key, _ := hex.DecodeString(v.key)
+		nonce, _ := hex.DecodeString(v.nonce)
+		plain, _ := hex.DecodeString(v.plain)
+		data, _ := hex.DecodeString(v.data)
+		a, err := NewGCMSIV(key)
+		if err != nil {
+			t.Fatalf("Failed to create AEAD: %v", err)
+		}
+		sealed := a.Seal(nil, nonce, plain, data)
+		if hex.EncodeToString(sealed) != v.result {
+			t.Fatalf("Result mismatch: %x", sealed)
+		}
+		opened, err := a.Open(nil, nonce, sealed, data)
+		if err != nil || !bytes.Equal(opened, plain) {
+			t.Fatalf("Failed to open: %v", err)
+		}
+	}
+}
+
+func TestGCMSIV(t *testing.T) {
+	key := make([]byte, 32)
+	nonce := make([]byte, 12)
+	a, _ := NewGCMSIV(key)
+	data := []byte("additional data")
+	for _, n := range []int{1, 15, 16, 17, 100, PayloadMaxSize} {
+		plain := bytes.Repeat([]byte{byte(n)}, n)
+		sealed := a.Seal(nil, nonce, plain, data)
+		// deterministic, a reused nonce only reveals the same message
+		if !bytes.Equal(sealed, a.Seal(nil, nonce, plain, data)) {
+			t.Fatal("Seal should be deterministic")
+		}
+		// in place
+		buf := append([]byte{}, sealed...)
+		opened, err := a.Open(buf[:0], nonce, buf, data)
+		if err != nil || !bytes.Equal(opened, plain) {
+			t.Fatalf("Failed to open %d bytes: %v", n, err)
+		}
+		sealed[n/2] ^= 1
+		if _, err = a.Open(nil, nonce, sealed, data); err != ErrGCMSIVOpen {
+			t.Fatalf("Should fail with tampered ciphertext: %v", err)
+		}
+	}
+
+	// packets with the same salt
+	c, _ := NewCipher("AEAD_AES_256_GCM_SIV", "hello")
+	if cipherName(c) != "AEAD_AES_256_GCM_SIV" {
+		t.Fatalf("Bad cipher name %s", cipherName(c))
+	}
+	salt := make([]byte, c.SaltSize())
+	a1, _ := c.CreateAEAD(salt)
+	a2, _ := c.CreateAEAD(salt)
+	p1 := a1.Seal(nil, nonce, []byte("hello"), nil)
+	p2 := a1.Seal(nil, nonce, []byte("world"), nil)
+	if bytes.Equal(p1[:5], p2[:5]) {
+		t.Fatal("Keystream should differ for different packets")
+	}
+	if res, err := a2.Open(nil, nonce, p2, nil); err != nil || string(res) != "world" {
+		t.Fatalf("Failed to open packet: %v", err)
+	}
+}
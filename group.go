@@ -0,0 +1,339 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrEmptyGroup ServerGroup has no server
+var ErrEmptyGroup = errors.New("server group is empty")
+
+// GroupStrategy strategy of choosing server in ServerGroup
+type GroupStrategy int
+
+// strategies of ServerGroup
+const (
+	// servers in turn
+	StrategyRoundRobin GroupStrategy = iota
+	// server with the lowest health check latency
+	StrategyLeastLatency
+	// server chosen by hash of destination host, so a destination sticks to a server
+	StrategyConsistentHash
+)
+
+// defaults of ServerGroup
+const (
+	DefaultHealthCheckInterval = 30 * time.Second
+	DefaultHealthCheckTimeout  = 5 * time.Second
+)
+
+// virtual nodes of each server on consistent hash ring
+const groupHashReplicas = 64
+
+// ServerHealth health of a server in ServerGroup
+type ServerHealth struct {
+	Name    string
+	Address string
+	Healthy bool
+	// round trip time of last successful health check
+	Latency   time.Duration
+	LastCheck time.Time
+	LastError error
+	// consecutive failures
+	Failures int
+}
+
+// groupMember a server in ServerGroup
+type groupMember struct {
+	dialer *Dialer
+	health ServerHealth
+}
+
+// ServerGroup dials targets through one of several FleeGrid servers, implements ProxyDialer
+//
+// Servers are tried in order of Strategy, healthy servers first, a server failed to connect is marked
+// unhealthy and the next one is tried. Health checks dial HealthCheckTarget through each server and wait
+// for the response of a HTTP HEAD request, or open a mux stream and wait for the server to reset it if
+// HealthCheckTarget is empty, so a server with mismatched cipher or not responding is unhealthy.
+type ServerGroup struct {
+	Strategy GroupStrategy
+	// interval of periodic health checks
+	HealthCheckInterval time.Duration
+	// timeout of each health check
+	HealthCheckTimeout time.Duration
+	// host:port of a HTTP server for health checks, a mux stream is opened instead if empty
+	HealthCheckTarget string
+
+	lock    sync.RWMutex
+	members []*groupMember
+	ring    []groupHashNode
+	counter uint32
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// groupHashNode a virtual node on consistent hash ring
+type groupHashNode struct {
+	hash   uint32
+	member *groupMember
+}
+
+// NewServerGroup create a new ServerGroup of Configs, Config.Name is used as server name, index is used if empty
+func NewServerGroup(strategy GroupStrategy, configs ...*Config) (*ServerGroup, error) {
+	if len(configs) == 0 {
+		return nil, ErrEmptyGroup
+	}
+	g := &ServerGroup{Strategy: strategy, stop: make(chan struct{})}
+	for i, config := range configs {
+		d, err := NewDialer(config)
+		if err != nil {
+			return nil, err
+		}
+		name := config.Name
+		if len(name) == 0 {
+			name = strconv.Itoa(i)
+		}
+		m := &groupMember{dialer: d, health: ServerHealth{Name: name, Address: config.Address, Healthy: true}}
+		g.members = append(g.members, m)
+		for j := 0; j < groupHashReplicas; j++ {
+			h := crc32.ChecksumIEEE([]byte(name + "#" + strconv.Itoa(j)))
+			g.ring = append(g.ring, groupHashNode{hash: h, member: m})
+		}
+	}
+	sort.Slice(g.ring, func(i, j int) bool { return g.ring[i].hash < g.ring[j].hash })
+	return g, nil
+}
+
+// candidates returns servers to try for a target address, in order
+func (g *ServerGroup) candidates(address string) []*groupMember {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	var ordered []*groupMember
+	switch g.Strategy {
+	case StrategyLeastLatency:
+		ordered = append(ordered, g.members...)
+		// latency of unchecked servers is 0, they are tried last
+		sort.SliceStable(ordered, func(i, j int) bool {
+			li, lj := ordered[i].health.Latency, ordered[j].health.Latency
+			if li == 0 || lj == 0 {
+				return lj == 0 && li != 0
+			}
+			return li < lj
+		})
+	case StrategyConsistentHash:
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		h := crc32.ChecksumIEEE([]byte(host))
+		start := sort.Search(len(g.ring), func(i int) bool { return g.ring[i].hash >= h })
+		seen := map[*groupMember]bool{}
+		for i := 0; i < len(g.ring) && len(ordered) < len(g.members); i++ {
+			m := g.ring[(start+i)%len(g.ring)].member
+			if !seen[m] {
+				seen[m] = true
+				ordered = append(ordered, m)
+			}
+		}
+	default:
+		start := int(atomic.AddUint32(&g.counter, 1)-1) % len(g.members)
+		for i := range g.members {
+			ordered = append(ordered, g.members[(start+i)%len(g.members)])
+		}
+	}
+
+	// healthy servers first
+	result := make([]*groupMember, 0, len(ordered))
+	for _, m := range ordered {
+		if m.health.Healthy {
+			result = append(result, m)
+		}
+	}
+	for _, m := range ordered {
+		if !m.health.Healthy {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// report records result of a health check or a connection attempt
+func (g *ServerGroup) report(m *groupMember, latency time.Duration, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	m.health.LastError = err
+	if err != nil {
+		m.health.Healthy = false
+		m.health.Failures++
+		return
+	}
+	m.health.Healthy = true
+	m.health.Failures = 0
+	if latency > 0 {
+		m.health.Latency = latency
+	}
+}
+
+// DialContext dials target through servers in order, until one succeeds
+func (g *ServerGroup) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var lastErr error
+	for _, m := range g.candidates(address) {
+		conn, err := m.dialer.DialContext(ctx, network, address)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if _, ok := err.(net.Error); !ok {
+			return nil, err
+		}
+		g.report(m, 0, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// ListenPacket creates a net.PacketConn through the first server in order
+// UDP is connectionless, failover happens on next ListenPacket after health checks
+func (g *ServerGroup) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	var lastErr error
+	for _, m := range g.candidates("") {
+		pc, err := m.dialer.ListenPacket(ctx)
+		if err == nil {
+			return pc, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// Health returns current health of servers
+func (g *ServerGroup) Health() []ServerHealth {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	health := make([]ServerHealth, len(g.members))
+	for i, m := range g.members {
+		health[i] = m.health
+	}
+	return health
+}
+
+// Check runs health check on all servers concurrently, and waits for results
+func (g *ServerGroup) Check(ctx context.Context) {
+	timeout := g.HealthCheckTimeout
+	if timeout == 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	var wg sync.WaitGroup
+	for _, m := range g.members {
+		wg.Add(1)
+		go func(m *groupMember) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			start := time.Now()
+			err := g.probe(ctx, m.dialer)
+			g.report(m, time.Since(start), err)
+			g.lock.Lock()
+			m.health.LastCheck = time.Now()
+			g.lock.Unlock()
+		}(m)
+	}
+	wg.Wait()
+}
+
+// probe sends a HTTP HEAD request to HealthCheckTarget through server, and waits for response
+// if HealthCheckTarget is empty, a mux stream without target is opened, and reset by server
+func (g *ServerGroup) probe(ctx context.Context, d *Dialer) error {
+	target := g.HealthCheckTarget
+	if len(target) == 0 {
+		return probeMux(ctx, d)
+	}
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	conn, err := d.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err = conn.Write([]byte("HEAD / HTTP/1.1\r\nHost: " + host + "\r\nConnection: close\r\n\r\n")); err != nil {
+		return err
+	}
+	_, err = conn.Read(make([]byte, 1))
+	return err
+}
+
+// probeMux opens a mux session through server, and waits for an empty stream to be reset
+// the reset frame is decrypted, so it proves that server accepts cipher and responds
+func probeMux(ctx context.Context, d *Dialer) error {
+	conn, err := d.DialContext(ctx, "tcp", MuxAddress)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	session := NewMuxSession(conn, true, nil)
+	defer session.Close()
+	st, err := session.OpenStream()
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		st.SetDeadline(deadline)
+	}
+	if err = st.CloseWrite(); err != nil {
+		return err
+	}
+	_, err = st.Read(make([]byte, 1))
+	if session.IsClosed() {
+		// closed by server, like on mismatched cipher
+		return session.closeErr()
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// Start runs health checks every HealthCheckInterval in a goroutine, until Close
+func (g *ServerGroup) Start() {
+	interval := g.HealthCheckInterval
+	if interval == 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			g.Check(context.Background())
+			select {
+			case <-ticker.C:
+			case <-g.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops periodic health checks
+func (g *ServerGroup) Close() error {
+	g.once.Do(func() {
+		close(g.stop)
+	})
+	return nil
+}
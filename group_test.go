@@ -0,0 +1,148 @@
+package core
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const groupServerAddr1 = ":12326"
+const groupServerAddr2 = ":12327"
+const groupEchoAddr = ":12328"
+
+func TestServerGroup(t *testing.T) {
+	config1, _ := ParseConfigFromURL("flee://hello@127.0.0.1" + groupServerAddr1 + "#a")
+	config2, _ := ParseConfigFromURL("flee://world@127.0.0.1" + groupServerAddr2 + "#b")
+
+	echo := startTestEchoServer(t, groupEchoAddr)
+	defer echo.Close()
+	// Server supports mux sessions of health checks
+	serve := func(config *Config) net.Listener {
+		s, err := NewServer(config)
+		if err != nil {
+			t.Fatalf("Cannot create Server: %v", err)
+		}
+		l, err := net.Listen("tcp", config.Address)
+		if err != nil {
+			t.Fatalf("Cannot listen socket: %v", err)
+		}
+		go s.Serve(l)
+		return l
+	}
+	fl1 := serve(config1)
+	fl2 := serve(config2)
+	defer fl2.Close()
+
+	if _, err := NewServerGroup(StrategyRoundRobin); err != ErrEmptyGroup {
+		t.Fatal("Should fail with empty group")
+	}
+	g, err := NewServerGroup(StrategyRoundRobin, config1, config2)
+	if err != nil {
+		t.Fatalf("Cannot create ServerGroup: %v", err)
+	}
+	defer g.Close()
+	g.HealthCheckTarget = "127.0.0.1" + groupEchoAddr
+
+	roundTrip := func() {
+		conn, err := g.DialContext(context.Background(), "tcp", "127.0.0.1"+groupEchoAddr)
+		if err != nil {
+			t.Fatalf("Cannot dial: %v", err)
+		}
+		defer conn.Close()
+		str := randomPayloadString()
+		go conn.Write([]byte(str))
+		res := make([]byte, len(str))
+		if _, err = io.ReadFull(conn, res); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if string(res) != str {
+			t.Fatal("Str mismatch")
+		}
+	}
+
+	// round robin
+	if g.candidates("")[0].health.Name != "a" || g.candidates("")[0].health.Name != "b" {
+		t.Fatal("Round robin order mismatch")
+	}
+	roundTrip()
+
+	// health check
+	g.Check(context.Background())
+	for _, h := range g.Health() {
+		if !h.Healthy || h.Latency <= 0 || h.LastCheck.IsZero() || h.LastError != nil {
+			t.Fatalf("Server %s should be healthy: %v", h.Name, h.LastError)
+		}
+	}
+
+	// failover
+	fl1.Close()
+	g.Check(context.Background())
+	health := g.Health()
+	if health[0].Healthy || health[0].Failures != 1 || !health[1].Healthy {
+		t.Fatal("Server a should be unhealthy")
+	}
+	for i := 0; i < 4; i++ {
+		if g.candidates("")[0].health.Name != "b" {
+			t.Fatal("Healthy server should be tried first")
+		}
+	}
+	roundTrip()
+	roundTrip()
+
+	// connection failure marks server unhealthy
+	g.report(g.members[0], 0, nil)
+	g.counter = 0
+	roundTrip()
+	if h := g.Health()[0]; h.Healthy || h.Failures != 1 {
+		t.Fatal("Server a should be marked unhealthy on failed dial")
+	}
+
+	// least latency
+	g.Strategy = StrategyLeastLatency
+	g.report(g.members[0], 1, nil)
+	g.report(g.members[1], 2, nil)
+	if g.candidates("")[0].health.Name != "a" {
+		t.Fatal("Least latency server should be tried first")
+	}
+	// unchecked server is tried last
+	g.members[0].health.Latency = 0
+	if g.candidates("")[0].health.Name != "b" {
+		t.Fatal("Unchecked server should be tried last")
+	}
+
+	// consistent hash
+	g.Strategy = StrategyConsistentHash
+	hits := map[string]int{}
+	for i := 0; i < 100; i++ {
+		host := "host" + randomPayloadString()[:8] + ".com:443"
+		first := g.candidates(host)[0].health.Name
+		if g.candidates(host)[0].health.Name != first {
+			t.Fatal("Consistent hash should be stable")
+		}
+		hits[first]++
+	}
+	if hits["a"] == 0 || hits["b"] == 0 {
+		t.Fatalf("Consistent hash should spread destinations: %v", hits)
+	}
+	// without target, health check opens a mux stream
+	g.HealthCheckTarget = ""
+	g.Check(context.Background())
+	if health = g.Health(); health[0].Healthy || !health[1].Healthy || health[1].Latency <= 0 {
+		t.Fatal("Server a should be unhealthy, server b should be healthy")
+	}
+
+	// mismatched cipher
+	bad, _ := ParseConfigFromURL("flee://wrong@127.0.0.1" + groupServerAddr2 + "#bad")
+	g, err = NewServerGroup(StrategyRoundRobin, bad)
+	if err != nil {
+		t.Fatalf("Cannot create ServerGroup: %v", err)
+	}
+	defer g.Close()
+	g.HealthCheckTimeout = time.Second
+	g.Check(context.Background())
+	if h := g.Health()[0]; h.Healthy || h.LastError == nil {
+		t.Fatal("Server with mismatched cipher should be unhealthy")
+	}
+}
@@ -0,0 +1,162 @@
+package core
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// hop-by-hop headers, should not be forwarded by proxy
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// HTTPProxy a HTTP proxy handling CONNECT and plain HTTP requests, tunneling through ProxyDialer
+type HTTPProxy struct {
+	// dialer for targets, usually a *Dialer
+	Dialer ProxyDialer
+	// optional username and password, for basic authentication
+	Username string
+	Passwd   string
+
+	once      sync.Once
+	transport *http.Transport
+}
+
+// NewHTTPProxy create a new HTTPProxy tunneling through FleeGrid server of Config
+func NewHTTPProxy(config *Config) (*HTTPProxy, error) {
+	d, err := NewDialer(config)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPProxy{Dialer: d}, nil
+}
+
+// ListenAndServe listens on a TCP address and serves
+func (p *HTTPProxy) ListenAndServe(address string) error {
+	return (&http.Server{Addr: address, Handler: p}).ListenAndServe()
+}
+
+// Serve accepts connections from net.Listener and serves
+func (p *HTTPProxy) Serve(l net.Listener) error {
+	return (&http.Server{Handler: p}).Serve(l)
+}
+
+// ServeHTTP handles a proxy request
+func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !p.authorized(r) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="FleeGrid"`)
+		http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		p.connect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "absolute URI is required", http.StatusBadRequest)
+		return
+	}
+	p.forward(w, r)
+}
+
+// authorized checks Proxy-Authorization header
+func (p *HTTPProxy) authorized(r *http.Request) bool {
+	if len(p.Username) == 0 && len(p.Passwd) == 0 {
+		return true
+	}
+	auth := r.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return false
+	}
+	return string(b) == p.Username+":"+p.Passwd
+}
+
+// connect handles CONNECT request
+func (p *HTTPProxy) connect(w http.ResponseWriter, r *http.Request) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking is not supported", http.StatusInternalServerError)
+		return
+	}
+	rconn, err := p.Dialer.DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer rconn.Close()
+
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if _, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	// bytes already buffered from client
+	if n := buf.Reader.Buffered(); n > 0 {
+		b, _ := buf.Reader.Peek(n)
+		if _, err = rconn.Write(b); err != nil {
+			return
+		}
+	}
+	Relay(conn, rconn)
+}
+
+// forward handles plain HTTP request
+func (p *HTTPProxy) forward(w http.ResponseWriter, r *http.Request) {
+	p.once.Do(func() {
+		p.transport = &http.Transport{DialContext: p.Dialer.DialContext}
+	})
+
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	removeHopHeaders(req.Header)
+
+	res, err := p.transport.RoundTrip(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+
+	removeHopHeaders(res.Header)
+	for k, vs := range res.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+}
+
+// removeHopHeaders removes hop-by-hop headers, including those listed in Connection
+func removeHopHeaders(h http.Header) {
+	for _, f := range h["Connection"] {
+		for _, k := range strings.Split(f, ",") {
+			if k = strings.TrimSpace(k); len(k) > 0 {
+				h.Del(k)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
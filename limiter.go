@@ -0,0 +1,129 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter a token bucket rate limiter in bytes per second, safe for concurrent use
+// a Limiter can be shared by many connections, rate can be changed at runtime
+type Limiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter create a new Limiter with rate (bytes per second) and burst (bytes), rate 0 for unlimited
+func NewLimiter(rate, burst int) *Limiter {
+	l := &Limiter{}
+	l.SetRate(rate, burst)
+	l.tokens = l.burst
+	return l
+}
+
+// SetRate change rate and burst, rate 0 for unlimited
+func (l *Limiter) SetRate(rate, burst int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.advance(time.Now())
+	if burst < rate/10 {
+		// at least 100ms of traffic, or limiter waits too often
+		burst = rate / 10
+	}
+	l.rate, l.burst = float64(rate), float64(burst)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Rate returns current rate and burst
+func (l *Limiter) Rate() (rate, burst int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return int(l.rate), int(l.burst)
+}
+
+// advance refill tokens up to now
+func (l *Limiter) advance(now time.Time) {
+	if !l.last.IsZero() && l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+}
+
+// reserve take n tokens, returns how long to wait before using them
+func (l *Limiter) reserve(n int) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	l.advance(now)
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// WaitN blocks until n bytes are allowed, n can be larger than burst
+func (l *Limiter) WaitN(n int) {
+	if l == nil {
+		return
+	}
+	if d := l.reserve(n); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// waitAll waits on all limiters
+func waitAll(ls []*Limiter, n int) {
+	for _, l := range ls {
+		l.WaitN(n)
+	}
+}
+
+// UserLimiters holds a Limiter for each user, users without explicit rate use default rate
+type UserLimiters struct {
+	lock        sync.Mutex
+	rate, burst int
+	limiters    map[string]*Limiter
+}
+
+// NewUserLimiters create a new UserLimiters with default rate and burst, rate 0 for unlimited
+func NewUserLimiters(rate, burst int) *UserLimiters {
+	return &UserLimiters{rate: rate, burst: burst, limiters: map[string]*Limiter{}}
+}
+
+// Get returns Limiter of a user, creates one with default rate if not existed
+func (u *UserLimiters) Get(user string) *Limiter {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	l := u.limiters[user]
+	if l == nil {
+		l = NewLimiter(u.rate, u.burst)
+		u.limiters[user] = l
+	}
+	return l
+}
+
+// SetRate change rate and burst of a user
+func (u *UserLimiters) SetRate(user string, rate, burst int) {
+	u.Get(user).SetRate(rate, burst)
+}
+
+// limitersOf returns limiters applied to user, including fixed limiters
+func (u *UserLimiters) limitersOf(fixed []*Limiter, user string) []*Limiter {
+	if u == nil {
+		return fixed
+	}
+	ret := make([]*Limiter, 0, len(fixed)+1)
+	ret = append(ret, fixed...)
+	return append(ret, u.Get(user))
+}
@@ -0,0 +1,126 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+const limiterStreamAddr = ":12308"
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(100*1024, 10*1024)
+	start := time.Now()
+	// burst is free, the rest takes 200ms
+	for i := 0; i < 30; i++ {
+		l.WaitN(1024)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond || d > time.Second {
+		t.Fatalf("Bad duration: %v", d)
+	}
+
+	// unlimited
+	l.SetRate(0, 0)
+	start = time.Now()
+	l.WaitN(1024 * 1024)
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("Should not wait when unlimited: %v", d)
+	}
+	if r, _ := l.Rate(); r != 0 {
+		t.Fatalf("Rate should be 0")
+	}
+}
+
+func TestStreamConnLimiter(t *testing.T) {
+	c, _ := NewCipher("AEAD_CHACHA20_POLY1305", "hello")
+
+	l, err := net.Listen("tcp", limiterStreamAddr)
+	if err != nil {
+		t.Fatalf("Cannot listen socket")
+	}
+	defer l.Close()
+
+	// shared by server side connections
+	shared := NewLimiter(200*1024, 20*1024)
+
+	done := make(chan int, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				break
+			}
+			go func() {
+				sconn := NewStreamConn(conn, c)
+				sconn.SetLimiters(shared)
+				// WriteTo fast path
+				n, _ := sconn.WriteTo(ioutil.Discard)
+				done <- int(n)
+				sconn.Close()
+			}()
+		}
+	}()
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1"+limiterStreamAddr)
+		if err != nil {
+			t.Fatal("Cannot dial socket")
+		}
+		cconn := NewStreamConn(conn, c)
+		go func() {
+			// ReadFrom fast path
+			cconn.ReadFrom(bytes.NewReader(make([]byte, 60*1024)))
+			cconn.Close()
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if n := <-done; n != 60*1024 {
+			t.Fatalf("Bad size: %v", n)
+		}
+	}
+	// 120k in total with 20k burst at 200k/s
+	if d := time.Since(start); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("Bad duration: %v", d)
+	}
+}
+
+// discardPacketConn a net.PacketConn discarding written packets
+type discardPacketConn struct {
+	net.PacketConn
+}
+
+func (discardPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return len(b), nil
+}
+
+func TestPacketConnUserLimiter(t *testing.T) {
+	m, _ := createTestUsers(t)
+	users := map[string]*userCipher{}
+	for _, u := range m.snapshot() {
+		users[u.user] = u
+	}
+	conn, _ := NewMultiUserPacketConn(discardPacketConn{}, m)
+	ul := NewUserLimiters(0, 0)
+	// 1k burst, then 10k/s
+	ul.SetRate("bob", 10*1024, 1024)
+	conn.SetUserLimiters(ul)
+	bob, _ := net.ResolveUDPAddr("udp", "127.0.0.1:1")
+	alice, _ := net.ResolveUDPAddr("udp", "127.0.0.1:2")
+	conn.setPeerCipher(bob, users["bob"])
+	conn.setPeerCipher(alice, users["alice"])
+
+	conn.WriteTo(make([]byte, 900), bob)
+	go conn.WriteTo(make([]byte, 4*1024), bob)
+	time.Sleep(20 * time.Millisecond)
+	// bob is throttled, alice is not blocked
+	start := time.Now()
+	if _, err := conn.WriteTo(make([]byte, 1024), alice); err != nil {
+		t.Fatalf("Cannot write: %v", err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("Should not be blocked by throttled user: %v", d)
+	}
+}
@@ -0,0 +1,115 @@
+package core
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrMemoryLockNotSupported locking memory is only supported on Linux
+var ErrMemoryLockNotSupported = errors.New("locking memory is not supported on this platform")
+
+// LockKeyMemory allocates master keys in memory locked by mlock, so they are never swapped to disk
+// only supported on Linux, keys are allocated normally if locking fails, see RLIMIT_MEMLOCK
+var LockKeyMemory = false
+
+// locked keys allocated by allocLocked, by address of first byte
+var (
+	lockedKeys     = map[*byte][]byte{}
+	lockedKeysLock sync.Mutex
+)
+
+// newKey allocates a key of n bytes, locked in memory if LockKeyMemory is set
+func newKey(n int) []byte {
+	if LockKeyMemory && n > 0 {
+		if b, err := allocLocked(n); err == nil {
+			lockedKeysLock.Lock()
+			lockedKeys[&b[0]] = b
+			lockedKeysLock.Unlock()
+			return b
+		}
+	}
+	return make([]byte, n)
+}
+
+// copyKey copies a key into memory allocated by newKey, so ciphers sharing a password can be destroyed separately
+// a destroyed key is not copied
+func copyKey(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	k := newKey(len(b))
+	copy(k, b)
+	return k
+}
+
+// destroyKey zeroes a key, and releases locked memory of key allocated by newKey
+func destroyKey(b []byte) {
+	zeroBytes(b)
+	if len(b) == 0 {
+		return
+	}
+	lockedKeysLock.Lock()
+	locked := lockedKeys[&b[0]]
+	delete(lockedKeys, &b[0])
+	lockedKeysLock.Unlock()
+	if locked != nil {
+		freeLocked(locked)
+	}
+}
+
+// masterKey a key allocated by newKey, destroying it waits for derivations in progress
+// so locked memory is never released while in use
+type masterKey struct {
+	sync.RWMutex
+	b []byte
+}
+
+// copy returns a masterKey with its own copy of key, see copyKey
+func (k *masterKey) copy() *masterKey {
+	k.RLock()
+	defer k.RUnlock()
+	return &masterKey{b: copyKey(k.b)}
+}
+
+// use calls f with key, which is not destroyed until f returns, fails with ErrCipherDestroyed after destroy
+func (k *masterKey) use(f func(key []byte) error) error {
+	k.RLock()
+	defer k.RUnlock()
+	if k.b == nil {
+		return ErrCipherDestroyed
+	}
+	return f(k.b)
+}
+
+// derive derives subkey of salt into out with HKDF, see use
+func (k *masterKey) derive(h *HKDF, salt, out []byte) error {
+	return k.use(func(key []byte) error {
+		h.DeriveSubkey(key, salt, out)
+		return nil
+	})
+}
+
+// destroy zeroes key and releases its locked memory, see destroyKey
+func (k *masterKey) destroy() {
+	k.Lock()
+	defer k.Unlock()
+	destroyKey(k.b)
+	k.b = nil
+}
+
+// isLocked reports if key is allocated in locked memory
+func isLocked(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	lockedKeysLock.Lock()
+	defer lockedKeysLock.Unlock()
+	return lockedKeys[&b[0]] != nil
+}
+
+// zeroBytes overwrites b with zeros
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
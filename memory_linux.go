@@ -0,0 +1,24 @@
+package core
+
+import (
+	"syscall"
+)
+
+// allocLocked allocates n bytes in dedicated pages locked by mlock
+func allocLocked(n int) ([]byte, error) {
+	b, err := syscall.Mmap(-1, 0, n, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Mlock(b); err != nil {
+		syscall.Munmap(b)
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+// freeLocked releases memory allocated by allocLocked
+func freeLocked(b []byte) {
+	syscall.Munlock(b)
+	syscall.Munmap(b)
+}
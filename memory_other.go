@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package core
+
+// allocLocked is only supported on Linux
+func allocLocked(n int) ([]byte, error) {
+	return nil, ErrMemoryLockNotSupported
+}
+
+// freeLocked is only supported on Linux
+func freeLocked(b []byte) {
+}
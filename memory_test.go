@@ -0,0 +1,110 @@
+package core
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockKeyMemory(t *testing.T) {
+	LockKeyMemory = true
+	defer func() { LockKeyMemory = false }()
+
+	for _, name := range SupportedCipherNames {
+		// not destroyable, its key is never released
+		if name == "AEAD_DUMMY" {
+			continue
+		}
+		c, err := NewCipher(name, "hello")
+		if err != nil {
+			t.Fatalf("%v: Cannot create Cipher: %v", name, err)
+		}
+		if name == "AEAD_CHACHA20_POLY1305" {
+			if key := c.(*ChapoCipher).key.b; runtime.GOOS == "linux" && !isLocked(key) {
+				t.Log("Memory is not locked, RLIMIT_MEMLOCK may be too low")
+			}
+		}
+		if _, err = c.CreateAEAD(make([]byte, c.SaltSize())); err != nil {
+			t.Fatalf("%v: Cannot create AEAD: %v", name, err)
+		}
+		DestroyCipher(c)
+	}
+
+	lockedKeysLock.Lock()
+	n := len(lockedKeys)
+	lockedKeysLock.Unlock()
+	if n != 0 {
+		t.Fatalf("Memory should be released, %d keys are still locked", n)
+	}
+}
+
+func TestDestroyDerivedCipher(t *testing.T) {
+	LockKeyMemory = true
+	defer func() { LockKeyMemory = false }()
+
+	k, _ := NewHKDF("SHA256", nil)
+	priv, pub, _ := GenerateServerKey()
+	sk, _ := ServerKeyEncoding.DecodeString(priv)
+	pk, _ := ServerKeyEncoding.DecodeString(pub)
+	for _, name := range SupportedCipherNames {
+		c, _ := NewCipher(name, "hello")
+		derived := []Cipher{}
+		if hc, ok := c.(HKDFCipher); ok {
+			derived = append(derived, hc.WithHKDF(k))
+		}
+		if kc, ok := c.(ServerKeyCipher); ok {
+			d1, _ := kc.WithServerPublicKey(pk)
+			d2, _ := kc.WithServerPrivateKey(sk)
+			derived = append(derived, d1, d2)
+		}
+		// destroying parent leaves derived ciphers usable, and the other way around
+		DestroyCipher(c)
+		for _, d := range derived {
+			if _, err := d.CreateAEAD(make([]byte, d.SaltSize())); err != nil {
+				t.Fatalf("%v: derived cipher should work after parent is destroyed; error: %v", name, err)
+			}
+			DestroyCipher(d)
+		}
+		if _, ok := c.(DestroyableCipher); ok {
+			if _, err := c.CreateAEAD(make([]byte, c.SaltSize())); err != ErrCipherDestroyed {
+				t.Fatalf("%v: should fail after Destroy; error: %v", name, err)
+			}
+		}
+	}
+}
+
+func TestDestroyCipherInUse(t *testing.T) {
+	LockKeyMemory = true
+	defer func() { LockKeyMemory = false }()
+
+	for _, name := range SupportedCipherNames {
+		c, _ := NewCipher(name, "hello")
+		if _, ok := c.(DestroyableCipher); !ok {
+			continue
+		}
+		// subkeys are derived until the cipher is destroyed
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				salt := make([]byte, c.SaltSize())
+				for {
+					if hc, ok := c.(HandshakeCipher); ok {
+						hc.VerifyHello(make([]byte, hc.HelloSize()))
+					}
+					if _, err := c.CreateAEAD(salt); err != nil {
+						if err != ErrCipherDestroyed {
+							t.Errorf("%v: should fail with ErrCipherDestroyed; error: %v", name, err)
+						}
+						return
+					}
+				}
+			}()
+		}
+		time.Sleep(10 * time.Millisecond)
+		DestroyCipher(c)
+		wg.Wait()
+	}
+}
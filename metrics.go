@@ -0,0 +1,303 @@
+package core
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MetricsPrefix prefix of metric names and name of expvar variable
+var MetricsPrefix = "fleegrid"
+
+var (
+	// RecordSizeBuckets upper bounds of record size histogram in bytes
+	RecordSizeBuckets = []float64{64, 256, 1024, 4096, 8192, PayloadMaxSize}
+	// HandshakeLatencyBuckets upper bounds of handshake latency histogram in seconds
+	HandshakeLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+)
+
+// Histogram a cumulative histogram, safe for concurrent use
+type Histogram struct {
+	lock    sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// NewHistogram create a Histogram with bucket upper bounds
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// Observe add a value to Histogram
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// HistogramSnapshot a point-in-time copy of Histogram, Counts are cumulative
+type HistogramSnapshot struct {
+	Buckets []float64
+	Counts  []uint64
+	Sum     float64
+	Count   uint64
+}
+
+// Snapshot returns current values of Histogram
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return HistogramSnapshot{
+		Buckets: h.buckets,
+		Counts:  append([]uint64(nil), h.counts...),
+		Sum:     h.sum,
+		Count:   h.count,
+	}
+}
+
+// cipherBytes bytes transferred with a cipher
+type cipherBytes struct {
+	in  uint64
+	out uint64
+}
+
+// Metrics process-wide metrics of StreamConn and PacketConn
+type Metrics struct {
+	connectionsAccepted uint64
+	connectionsActive   int64
+	saltsRejected       uint64
+	authFailures        uint64
+	packetsIn           uint64
+	packetsOut          uint64
+
+	lock    sync.RWMutex
+	ciphers map[string]*cipherBytes
+
+	// RecordSizes payload size of records and packets
+	RecordSizes *Histogram
+	// HandshakeLatency time spent waiting for peer salt
+	HandshakeLatency *Histogram
+}
+
+var (
+	metricsValue atomic.Value
+	metricsOnce  sync.Once
+)
+
+// EnableMetrics enable process-wide metrics and publish them to expvar, safe to call multiple times
+func EnableMetrics() *Metrics {
+	metricsOnce.Do(func() {
+		m := &Metrics{
+			ciphers:          map[string]*cipherBytes{},
+			RecordSizes:      NewHistogram(RecordSizeBuckets),
+			HandshakeLatency: NewHistogram(HandshakeLatencyBuckets),
+		}
+		metricsValue.Store(m)
+		expvar.Publish(MetricsPrefix, expvar.Func(m.expvar))
+	})
+	return currentMetrics()
+}
+
+// currentMetrics returns enabled Metrics, or nil
+func currentMetrics() *Metrics {
+	m, _ := metricsValue.Load().(*Metrics)
+	return m
+}
+
+// cipherName returns name of cipher for metric labels
+func cipherName(c Cipher) string {
+	switch c := c.(type) {
+	case *ChapoCipher:
+		return "AEAD_CHACHA20_POLY1305"
+	case *AESGCMCipher:
+		return "AEAD_AES_" + strconv.Itoa(c.size*8) + "_GCM"
+	case *AESGCMSIVCipher:
+		return "AEAD_AES_" + strconv.Itoa(c.size*8) + "_GCM_SIV"
+	case *DummyCipher:
+		return "AEAD_DUMMY"
+	case *X25519Cipher:
+		return c.name
+	case *userCipher:
+		return cipherName(c.Cipher)
+	case nil:
+		return ""
+	}
+	return fmt.Sprintf("%T", c)
+}
+
+func (m *Metrics) bytes(cipher string) *cipherBytes {
+	m.lock.RLock()
+	b := m.ciphers[cipher]
+	m.lock.RUnlock()
+	if b != nil {
+		return b
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if b = m.ciphers[cipher]; b == nil {
+		b = &cipherBytes{}
+		m.ciphers[cipher] = b
+	}
+	return b
+}
+
+func (m *Metrics) recordIn(cipher string, n int) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.bytes(cipher).in, uint64(n))
+	m.RecordSizes.Observe(float64(n))
+}
+
+func (m *Metrics) recordOut(cipher string, n int) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.bytes(cipher).out, uint64(n))
+	m.RecordSizes.Observe(float64(n))
+}
+
+func (m *Metrics) packetIn(cipher string, n int) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.packetsIn, 1)
+	m.recordIn(cipher, n)
+}
+
+func (m *Metrics) packetOut(cipher string, n int) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.packetsOut, 1)
+	m.recordOut(cipher, n)
+}
+
+func (m *Metrics) authFailure() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.authFailures, 1)
+}
+
+func (m *Metrics) saltRejected() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.saltsRejected, 1)
+}
+
+func (m *Metrics) connectionAccepted(d time.Duration) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.connectionsAccepted, 1)
+	m.HandshakeLatency.Observe(d.Seconds())
+}
+
+func (m *Metrics) connectionOpened() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.connectionsActive, 1)
+}
+
+func (m *Metrics) connectionClosed() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.connectionsActive, -1)
+}
+
+// cipherNames returns sorted cipher names seen
+func (m *Metrics) cipherNames() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	names := make([]string, 0, len(m.ciphers))
+	for name := range m.ciphers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// expvar returns all metrics as a map for expvar
+func (m *Metrics) expvar() interface{} {
+	bytes := map[string]map[string]uint64{}
+	for _, name := range m.cipherNames() {
+		b := m.bytes(name)
+		bytes[name] = map[string]uint64{
+			"in":  atomic.LoadUint64(&b.in),
+			"out": atomic.LoadUint64(&b.out),
+		}
+	}
+	return map[string]interface{}{
+		"connections_accepted": atomic.LoadUint64(&m.connectionsAccepted),
+		"connections_active":   atomic.LoadInt64(&m.connectionsActive),
+		"salts_rejected":       atomic.LoadUint64(&m.saltsRejected),
+		"auth_failures":        atomic.LoadUint64(&m.authFailures),
+		"packets_in":           atomic.LoadUint64(&m.packetsIn),
+		"packets_out":          atomic.LoadUint64(&m.packetsOut),
+		"bytes":                bytes,
+		"record_sizes":         m.RecordSizes.Snapshot(),
+		"handshake_latency":    m.HandshakeLatency.Snapshot(),
+	}
+}
+
+// WritePrometheus writes all metrics in Prometheus text format
+func (m *Metrics) WritePrometheus(w io.Writer) {
+	p := MetricsPrefix + "_"
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s %s\n", p, name, help, p, name, typ)
+	}
+	histogram := func(name string, h HistogramSnapshot) {
+		for i, b := range h.Buckets {
+			fmt.Fprintf(w, "%s%s_bucket{le=\"%s\"} %d\n", p, name, strconv.FormatFloat(b, 'g', -1, 64), h.Counts[i])
+		}
+		fmt.Fprintf(w, "%s%s_bucket{le=\"+Inf\"} %d\n", p, name, h.Count)
+		fmt.Fprintf(w, "%s%s_sum %s\n", p, name, strconv.FormatFloat(h.Sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s%s_count %d\n", p, name, h.Count)
+	}
+
+	metric("connections_accepted_total", "counter", "Stream connections with peer salt accepted.")
+	fmt.Fprintf(w, "%sconnections_accepted_total %d\n", p, atomic.LoadUint64(&m.connectionsAccepted))
+	metric("connections_active", "gauge", "Stream connections currently open.")
+	fmt.Fprintf(w, "%sconnections_active %d\n", p, atomic.LoadInt64(&m.connectionsActive))
+	metric("salts_rejected_total", "counter", "Salts matching no user.")
+	fmt.Fprintf(w, "%ssalts_rejected_total %d\n", p, atomic.LoadUint64(&m.saltsRejected))
+	metric("auth_failures_total", "counter", "AEAD authentication failures.")
+	fmt.Fprintf(w, "%sauth_failures_total %d\n", p, atomic.LoadUint64(&m.authFailures))
+	metric("packets_total", "counter", "Packets transferred.")
+	fmt.Fprintf(w, "%spackets_total{direction=\"in\"} %d\n", p, atomic.LoadUint64(&m.packetsIn))
+	fmt.Fprintf(w, "%spackets_total{direction=\"out\"} %d\n", p, atomic.LoadUint64(&m.packetsOut))
+	metric("bytes_total", "counter", "Payload bytes transferred by cipher.")
+	for _, name := range m.cipherNames() {
+		b := m.bytes(name)
+		fmt.Fprintf(w, "%sbytes_total{cipher=%q,direction=\"in\"} %d\n", p, name, atomic.LoadUint64(&b.in))
+		fmt.Fprintf(w, "%sbytes_total{cipher=%q,direction=\"out\"} %d\n", p, name, atomic.LoadUint64(&b.out))
+	}
+	metric("record_size_bytes", "histogram", "Payload size of records and packets.")
+	histogram("record_size_bytes", m.RecordSizes.Snapshot())
+	metric("handshake_latency_seconds", "histogram", "Time spent waiting for peer salt.")
+	histogram("handshake_latency_seconds", m.HandshakeLatency.Snapshot())
+}
+
+// ServeHTTP serves metrics in Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WritePrometheus(w)
+}
@@ -0,0 +1,127 @@
+package core
+
+import (
+	"bytes"
+	"expvar"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const metricsStreamAddr = ":12309"
+
+func TestMetrics(t *testing.T) {
+	m := EnableMetrics()
+	if EnableMetrics() != m {
+		t.Fatal("EnableMetrics should be idempotent")
+	}
+
+	c, _ := NewCipher("AEAD_AES_256_GCM", "hello")
+	accepted := atomic.LoadUint64(&m.connectionsAccepted)
+	failures := atomic.LoadUint64(&m.authFailures)
+
+	l, err := net.Listen("tcp", metricsStreamAddr)
+	if err != nil {
+		t.Fatalf("Cannot listen socket")
+	}
+	defer l.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				break
+			}
+			go func() {
+				sconn := NewServerStreamConn(conn, c)
+				_, err := ioutil.ReadAll(sconn)
+				sconn.Close()
+				done <- err
+			}()
+		}
+	}()
+
+	// good connection
+	conn, err := net.Dial("tcp", "127.0.0.1"+metricsStreamAddr)
+	if err != nil {
+		t.Fatal("Cannot dial socket")
+	}
+	cconn := NewStreamConn(conn, c)
+	cconn.ReadFrom(bytes.NewReader(make([]byte, 1000)))
+	cconn.Close()
+	if err = <-done; err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+
+	// bad connection
+	conn, err = net.Dial("tcp", "127.0.0.1"+metricsStreamAddr)
+	if err != nil {
+		t.Fatal("Cannot dial socket")
+	}
+	conn.Write(make([]byte, 128))
+	conn.Close()
+	if err = <-done; err == nil {
+		t.Fatal("Should fail to read")
+	}
+
+	if n := atomic.LoadUint64(&m.connectionsAccepted); n != accepted+2 {
+		t.Fatalf("Bad connections accepted: %v", n)
+	}
+	if n := atomic.LoadUint64(&m.authFailures); n != failures+1 {
+		t.Fatalf("Bad auth failures: %v", n)
+	}
+	if b := m.bytes("AEAD_AES_256_GCM"); atomic.LoadUint64(&b.in) < 1000 || atomic.LoadUint64(&b.out) < 1000 {
+		t.Fatalf("Bad bytes: %+v", b)
+	}
+
+	// prometheus
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	out := w.Body.String()
+	for _, line := range []string{
+		"# TYPE fleegrid_connections_accepted_total counter",
+		"fleegrid_bytes_total{cipher=\"AEAD_AES_256_GCM\",direction=\"in\"}",
+		"fleegrid_record_size_bytes_bucket{le=\"1024\"}",
+		"fleegrid_handshake_latency_seconds_count",
+	} {
+		if !strings.Contains(out, line) {
+			t.Fatalf("Missing %v in:\n%v", line, out)
+		}
+	}
+
+	// expvar
+	if v := expvar.Get(MetricsPrefix); v == nil || !strings.Contains(v.String(), "connections_accepted") {
+		t.Fatal("Metrics should be published to expvar")
+	}
+}
+
+func TestMetricsQuotaClose(t *testing.T) {
+	m := EnableMetrics()
+	c, _ := NewCipher("AEAD_AES_256_GCM", "hello")
+	stats := NewStats()
+	stats.SetQuota("", 100)
+	accepted := atomic.LoadUint64(&m.connectionsAccepted)
+
+	c1, c2 := net.Pipe()
+	cconn := NewStreamConn(c1, c)
+	go func() {
+		cconn.ReadFrom(bytes.NewReader(make([]byte, 1000)))
+		cconn.Close()
+	}()
+	sconn := NewServerStreamConn(c2, c)
+	sconn.SetStats(stats)
+	if _, err := ioutil.ReadAll(sconn); err != ErrQuotaExceeded {
+		t.Fatalf("Should exceed quota, got %v", err)
+	}
+	// closed through StreamConn, so active connections are decremented
+	if atomic.LoadInt32(&sconn.active) != 2 {
+		t.Fatal("StreamConn should be closed on quota exceeded")
+	}
+	if n := atomic.LoadUint64(&m.connectionsAccepted); n != accepted+1 {
+		t.Fatalf("Bad connections accepted: %v", n)
+	}
+}
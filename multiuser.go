@@ -0,0 +1,322 @@
+package core
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/cipher"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+)
+
+// ErrNoMatchingUser no user's cipher can decrypt the data
+var ErrNoMatchingUser = errors.New("no matching user")
+
+// PacketUserCacheSize maximum number of remote addresses remembered by a multi-user PacketConn
+var PacketUserCacheSize = 4096
+
+// userCipher a Cipher bound to a user
+type userCipher struct {
+	Cipher
+	user string
+}
+
+// headSize returns bytes needed to identify user, tag size of AEAD is assumed to be 16
+func (u *userCipher) headSize() int {
+	if hc, ok := u.Cipher.(HandshakeCipher); ok {
+		return hc.HelloSize()
+	}
+	return u.SaltSize() + 2 + 16
+}
+
+// MultiUserCipher holds ciphers of multiple users, identifies user by trial decryption
+// users recently matched are tried first
+type MultiUserCipher struct {
+	sync.Mutex
+	users *list.List
+	index map[string][]*list.Element
+}
+
+// NewMultiUserCipher create a new MultiUserCipher
+func NewMultiUserCipher() *MultiUserCipher {
+	return &MultiUserCipher{
+		users: list.New(),
+		index: map[string][]*list.Element{},
+	}
+}
+
+// Add add or replace a user with cipher
+func (m *MultiUserCipher) Add(user string, c Cipher) {
+	m.AddCiphers(user, c)
+}
+
+// AddCiphers add or replace a user accepting any of ciphers, like the same password with different ciphers
+func (m *MultiUserCipher) AddCiphers(user string, ciphers ...Cipher) {
+	m.Lock()
+	defer m.Unlock()
+	m.remove(user)
+	for _, c := range ciphers {
+		m.index[user] = append(m.index[user], m.users.PushBack(&userCipher{Cipher: c, user: user}))
+	}
+}
+
+// Remove remove a user
+func (m *MultiUserCipher) Remove(user string) {
+	m.Lock()
+	defer m.Unlock()
+	m.remove(user)
+}
+
+func (m *MultiUserCipher) remove(user string) {
+	for _, e := range m.index[user] {
+		m.users.Remove(e)
+	}
+	delete(m.index, user)
+}
+
+// Destroy removes all users and destroys their ciphers, see DestroyCipher
+func (m *MultiUserCipher) Destroy() {
+	m.Lock()
+	defer m.Unlock()
+	for e := m.users.Front(); e != nil; e = e.Next() {
+		DestroyCipher(e.Value.(*userCipher).Cipher)
+	}
+	m.users.Init()
+	m.index = map[string][]*list.Element{}
+}
+
+// Users returns names of all users, most recently matched first
+func (m *MultiUserCipher) Users() []string {
+	m.Lock()
+	defer m.Unlock()
+	ret := make([]string, 0, len(m.index))
+	seen := map[string]bool{}
+	for e := m.users.Front(); e != nil; e = e.Next() {
+		if user := e.Value.(*userCipher).user; !seen[user] {
+			seen[user] = true
+			ret = append(ret, user)
+		}
+	}
+	return ret
+}
+
+// snapshot returns all users in current order, so that trial decryption can run without lock
+func (m *MultiUserCipher) snapshot() []*userCipher {
+	m.Lock()
+	defer m.Unlock()
+	ret := make([]*userCipher, 0, m.users.Len())
+	for e := m.users.Front(); e != nil; e = e.Next() {
+		ret = append(ret, e.Value.(*userCipher))
+	}
+	return ret
+}
+
+// promote move a matched user to front
+func (m *MultiUserCipher) promote(u *userCipher) {
+	m.Lock()
+	defer m.Unlock()
+	for _, e := range m.index[u.user] {
+		if e.Value == u {
+			m.users.MoveToFront(e)
+		}
+	}
+}
+
+// has reports whether u is still a user
+func (m *MultiUserCipher) has(u *userCipher) bool {
+	m.Lock()
+	defer m.Unlock()
+	for _, e := range m.index[u.user] {
+		if e.Value == u {
+			return true
+		}
+	}
+	return false
+}
+
+// openStream reads salt and first length chunk from r, identifies user
+// returns AEAD and a io.Reader replaying bytes after salt
+// for HandshakeCipher, client hello is verified instead, AEAD is nil and the io.Reader replays client hello
+// bytes read are kept in head, so it can be retried after error like timeout
+func (m *MultiUserCipher) openStream(r io.Reader, head *[]byte) (*userCipher, io.Reader, cipher.AEAD, error) {
+	size := make([]byte, 2)
+	// client of HandshakeCipher sends hello only and waits, so users needing fewer bytes are tried first
+	users := m.snapshot()
+	sort.SliceStable(users, func(i, j int) bool {
+		return users[i].headSize() < users[j].headSize()
+	})
+	for _, u := range users {
+		if hc, ok := u.Cipher.(HandshakeCipher); ok {
+			if err := readAtLeast(r, head, hc.HelloSize()); err != nil {
+				return nil, nil, nil, err
+			}
+			if !hc.VerifyHello((*head)[:hc.HelloSize()]) {
+				continue
+			}
+			m.promote(u)
+			rest := io.MultiReader(bytes.NewReader(*head), r)
+			*head = nil
+			return u, rest, nil, nil
+		}
+		saltSize := u.SaltSize()
+		// salt is needed to create AEAD
+		if err := readAtLeast(r, head, saltSize); err != nil {
+			return nil, nil, nil, err
+		}
+		a, err := u.CreateAEAD((*head)[:saltSize])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		// first length chunk
+		need := saltSize + 2 + a.Overhead()
+		if err = readAtLeast(r, head, need); err != nil {
+			return nil, nil, nil, err
+		}
+		nonce := make([]byte, a.NonceSize())
+		if _, err = a.Open(size[:0], nonce, (*head)[saltSize:need], nil); err != nil {
+			continue
+		}
+		m.promote(u)
+		// replay bytes already read after salt
+		rest := io.MultiReader(bytes.NewReader((*head)[saltSize:]), r)
+		*head = nil
+		return u, rest, a, nil
+	}
+	return nil, nil, nil, ErrNoMatchingUser
+}
+
+// readAtLeast grows head to at least n bytes by reading from r, keeps bytes read on error
+func readAtLeast(r io.Reader, head *[]byte, n int) error {
+	l := len(*head)
+	if l >= n {
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, *head)
+	nr, err := io.ReadFull(r, b[l:])
+	*head = b[:l+nr]
+	return err
+}
+
+// openPacket decrypts a packet by trying each user, dst must not overlap src
+// the packetOpener is returned for the first packet of a session, if session packets are accepted
+func (m *MultiUserCipher) openPacket(dst, src []byte, session bool) ([]byte, *userCipher, *packetOpener, error) {
+	for _, u := range m.snapshot() {
+		b, o, err := openAnyPacket(dst, src, u, session)
+		if err == nil {
+			m.promote(u)
+			return b, u, o, nil
+		}
+		if err == io.ErrShortBuffer {
+			return nil, nil, nil, err
+		}
+	}
+	return nil, nil, nil, ErrNoMatchingUser
+}
+
+// OpenPacket decrypts packet by trying each user, returns plain text and user
+func (m *MultiUserCipher) OpenPacket(dst, src []byte) ([]byte, string, error) {
+	b, u, _, err := m.openPacket(dst, src, false)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, u.user, nil
+}
+
+// NewMultiUserStreamConn create a new StreamConn identifying user with MultiUserCipher
+// user is identified on first Read, Write before Read will read first
+func NewMultiUserStreamConn(conn net.Conn, m *MultiUserCipher) *StreamConn {
+	sc := &StreamConn{Conn: conn, users: m, server: true}
+	sc.meter.closer = sc
+	return sc
+}
+
+// MultiUserListener wraps a net.Listener, accepted connections are multi-user StreamConn
+type MultiUserListener struct {
+	net.Listener
+	Users *MultiUserCipher
+}
+
+// NewMultiUserListener create a new MultiUserListener
+func NewMultiUserListener(l net.Listener, m *MultiUserCipher) *MultiUserListener {
+	return &MultiUserListener{Listener: l, Users: m}
+}
+
+// Accept accepts a connection and wraps it with NewMultiUserStreamConn
+func (l *MultiUserListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewMultiUserStreamConn(conn, l.Users), nil
+}
+
+// NewMultiUserPacketConn wraps a net.PacketConn identifying user with MultiUserCipher
+// WriteTo uses the cipher of user last seen from the same address
+func NewMultiUserPacketConn(conn net.PacketConn, m *MultiUserCipher) (*PacketConn, error) {
+	return &PacketConn{
+		PacketConn: conn,
+		buf:        make([]byte, PacketMaxSize),
+		users:      m,
+		peers:      map[string]*userCipher{},
+	}, nil
+}
+
+// peerCipher returns cipher for a remote address
+func (c *PacketConn) peerCipher(addr net.Addr) (*userCipher, bool) {
+	c.plock.Lock()
+	defer c.plock.Unlock()
+	u, ok := c.peers[addr.String()]
+	return u, ok
+}
+
+// setPeerCipher remembers cipher for a remote address
+func (c *PacketConn) setPeerCipher(addr net.Addr, u *userCipher) {
+	c.plock.Lock()
+	defer c.plock.Unlock()
+	if _, ok := c.peers[addr.String()]; !ok && len(c.peers) >= PacketUserCacheSize {
+		// evict an arbitrary peer
+		for k := range c.peers {
+			delete(c.peers, k)
+			break
+		}
+	}
+	c.peers[addr.String()] = u
+}
+
+// ReadFromUser reads a packet, returns user identified for multi-user PacketConn
+func (c *PacketConn) ReadFromUser(b []byte) (int, net.Addr, string, error) {
+	if c.users == nil {
+		n, addr, err := c.ReadFrom(b)
+		return n, addr, "", err
+	}
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+	if c.rbuf == nil {
+		c.rbuf = make([]byte, PacketMaxSize)
+	}
+	n, addr, err := c.PacketConn.ReadFrom(c.rbuf)
+	if err != nil {
+		return 0, addr, "", err
+	}
+	p, u, session, err := c.openPacket(b, c.rbuf[:n])
+	if err != nil {
+		if err == ErrNoMatchingUser {
+			c.meter.authFailure("")
+			currentMetrics().authFailure()
+		}
+		return 0, addr, "", err
+	}
+	waitAll(c.userLimiters.limitersOf(c.limiters, u.user), n)
+	currentMetrics().packetIn(cipherName(u), len(p))
+	if err = c.meter.in(u.user, len(p)); err != nil {
+		return 0, addr, u.user, err
+	}
+	c.setPeerCipher(addr, u)
+	if c.acceptSession {
+		c.setSessionPeer(addr.String(), session)
+	}
+	return len(p), addr, u.user, nil
+}
@@ -0,0 +1,162 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+const multiUserStreamAddr = ":12304"
+const multiUserPacketAddr = ":12305"
+
+func createTestUsers(t *testing.T) (*MultiUserCipher, map[string]Cipher) {
+	ciphers := map[string]Cipher{}
+	m := NewMultiUserCipher()
+	for _, u := range []struct{ name, cipher, passwd string }{
+		{"alice", "AEAD_CHACHA20_POLY1305", "alice-passwd"},
+		{"bob", "AEAD_AES_128_GCM", "bob-passwd"},
+		{"carol", "AEAD_AES_256_GCM", "carol-passwd"},
+	} {
+		c, err := NewCipher(u.cipher, u.passwd)
+		if err != nil {
+			t.Fatalf("Cannot create Cipher: %v", err)
+		}
+		ciphers[u.name] = c
+		m.Add(u.name, c)
+	}
+	return m, ciphers
+}
+
+func TestMultiUserStreamConn(t *testing.T) {
+	m, ciphers := createTestUsers(t)
+
+	l, err := net.Listen("tcp", multiUserStreamAddr)
+	if err != nil {
+		t.Fatalf("Cannot listen socket")
+	}
+	ml := NewMultiUserListener(l, m)
+	defer ml.Close()
+
+	type result struct {
+		user string
+		data string
+		err  error
+	}
+	results := make(chan result, 1)
+
+	// server side, echo user and data
+	go func() {
+		for {
+			conn, err := ml.Accept()
+			if err != nil {
+				break
+			}
+			go func() {
+				sconn := conn.(*StreamConn)
+				res, err := ioutil.ReadAll(sconn)
+				results <- result{user: sconn.User(), data: string(res), err: err}
+				sconn.Close()
+			}()
+		}
+	}()
+
+	for _, name := range []string{"carol", "bob", "alice", "bob"} {
+		conn, err := net.Dial("tcp", "127.0.0.1"+multiUserStreamAddr)
+		if err != nil {
+			t.Fatal("Cannot dial socket")
+		}
+		cconn := NewStreamConn(conn, ciphers[name])
+		str := randomPayloadString()
+		go func() {
+			cconn.ReadFrom(bytes.NewBufferString(str))
+			cconn.Close()
+		}()
+		res := <-results
+		if res.err != nil {
+			t.Fatalf("Failed to read: %v", res.err)
+		}
+		if res.user != name {
+			t.Fatalf("User mismatch, expected %v, got %v", name, res.user)
+		}
+		if res.data != str {
+			t.Fatalf("Str mismatch")
+		}
+		if m.Users()[0] != name {
+			t.Fatalf("Matched user should be tried first")
+		}
+	}
+
+	// unknown user
+	unknown, _ := NewCipher("AEAD_CHACHA20_POLY1305", "unknown")
+	conn, err := net.Dial("tcp", "127.0.0.1"+multiUserStreamAddr)
+	if err != nil {
+		t.Fatal("Cannot dial socket")
+	}
+	cconn := NewStreamConn(conn, unknown)
+	cconn.Write([]byte("hello world!"))
+	res := <-results
+	if res.err != ErrNoMatchingUser {
+		t.Fatalf("Should fail with unknown user, got %v", res.err)
+	}
+	cconn.Close()
+}
+
+func TestMultiUserPacketConn(t *testing.T) {
+	m, ciphers := createTestUsers(t)
+
+	sn, err := net.ListenPacket("udp", "127.0.0.1"+multiUserPacketAddr)
+	if err != nil {
+		t.Fatal("Cannot listen socket")
+	}
+	sconn, err := NewMultiUserPacketConn(sn, m)
+	if err != nil {
+		t.Fatalf("Cannot create PacketConn: %v\n", err)
+	}
+	defer sconn.Close()
+
+	// server side, echo back with "user:" prefix
+	go func() {
+		buf := make([]byte, PacketMaxSize)
+		for {
+			n, addr, user, err := sconn.ReadFromUser(buf)
+			if err != nil {
+				if err == ErrNoMatchingUser {
+					continue
+				}
+				break
+			}
+			sconn.WriteTo(append([]byte(user+":"), buf[:n]...), addr)
+		}
+	}()
+
+	for _, name := range []string{"bob", "alice", "carol"} {
+		cn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Cannot listen socket: %v", err)
+		}
+		cconn, _ := NewPacketConn(cn, ciphers[name])
+		str := randomPacketString()
+		if _, err = cconn.WriteTo([]byte(str), sn.LocalAddr()); err != nil {
+			t.Fatalf("Can't write PacketConn:%v\n", err)
+		}
+		buf := make([]byte, PacketMaxSize)
+		n, _, err := cconn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Can't read PacketConn:%v\n", err)
+		}
+		if string(buf[:n]) != name+":"+str {
+			t.Fatal("str mismatch")
+		}
+		cconn.Close()
+	}
+
+	// unknown user
+	unknown, _ := NewCipher("AEAD_AES_128_GCM", "unknown")
+	plain := []byte("hello world!")
+	buf := make([]byte, PacketMaxSize)
+	b, _ := SealPacket(buf, plain, unknown)
+	if _, _, err = m.OpenPacket(make([]byte, PacketMaxSize), b); err != ErrNoMatchingUser {
+		t.Fatalf("Should fail with unknown user, got %v", err)
+	}
+}
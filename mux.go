@@ -0,0 +1,672 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrMuxSessionClosed mux session is closed
+	ErrMuxSessionClosed = errors.New("mux session closed")
+	// ErrMuxStreamClosed mux stream is closed, or writing side is shut down
+	ErrMuxStreamClosed = errors.New("mux stream closed")
+	// ErrMuxStreamReset mux stream is reset by peer
+	ErrMuxStreamReset = errors.New("mux stream reset by peer")
+	// ErrMuxBadFrame mux frame is mal-formatted
+	ErrMuxBadFrame = errors.New("bad mux frame")
+	// ErrMuxTimeout nothing received from peer within keepalive timeout
+	ErrMuxTimeout = errors.New("mux session keepalive timeout")
+)
+
+// MuxAddress target address requesting a mux session from FleeGrid server
+// each stream of the session starts with its own target address, as a StreamConn does
+const MuxAddress = "mux.fleegrid.arpa:0"
+
+// mux frame commands
+const (
+	// open stream
+	muxCmdSYN byte = iota
+	// no more data from sender, half close
+	muxCmdFIN
+	// data
+	muxCmdPSH
+	// keepalive
+	muxCmdNOP
+	// window update, payload is total bytes consumed by receiver, 4 bytes big endian
+	muxCmdUPD
+	// stream closed by sender, both directions
+	muxCmdRST
+)
+
+// mux frame: CMD(1) + STREAM ID(4) + LENGTH(2) + PAYLOAD
+const muxHeaderSize = 7
+
+// max payload size of a mux frame
+const muxMaxFrameSize = 32 * 1024
+
+// defaults of MuxConfig
+const (
+	DefaultMuxKeepAliveInterval = 10 * time.Second
+	DefaultMuxKeepAliveTimeout  = 30 * time.Second
+	DefaultMuxStreamWindow      = 256 * 1024
+	DefaultMuxAcceptBacklog     = 256
+	DefaultMuxMaxStreams        = 32
+)
+
+// MuxConfig options of MuxSession, zero values are replaced by defaults
+type MuxConfig struct {
+	// interval of keepalive frames
+	KeepAliveInterval time.Duration
+	// session is closed if nothing received within timeout
+	KeepAliveTimeout time.Duration
+	// receive window of each stream, must be the same on both sides
+	StreamWindow uint32
+	// streams opened by peer but not accepted yet
+	AcceptBacklog int
+}
+
+// withDefaults returns a copy of MuxConfig with defaults filled
+func (c *MuxConfig) withDefaults() MuxConfig {
+	var config MuxConfig
+	if c != nil {
+		config = *c
+	}
+	if config.KeepAliveInterval == 0 {
+		config.KeepAliveInterval = DefaultMuxKeepAliveInterval
+	}
+	if config.KeepAliveTimeout == 0 {
+		config.KeepAliveTimeout = DefaultMuxKeepAliveTimeout
+	}
+	if config.StreamWindow == 0 {
+		config.StreamWindow = DefaultMuxStreamWindow
+	}
+	if config.AcceptBacklog == 0 {
+		config.AcceptBacklog = DefaultMuxAcceptBacklog
+	}
+	return config
+}
+
+// MuxSession carries many MuxStream over a single net.Conn, usually a StreamConn
+type MuxSession struct {
+	conn   net.Conn
+	config MuxConfig
+
+	lock    sync.Mutex
+	streams map[uint32]*MuxStream
+	nextID  uint32
+
+	accepts chan *MuxStream
+
+	// serializes frames
+	wlock sync.Mutex
+
+	die     chan struct{}
+	dieOnce sync.Once
+	err     error
+
+	// unix nano of last received frame
+	lastRecv int64
+}
+
+// NewMuxSession create a new MuxSession over conn, and starts receiving
+// streams opened by client have odd IDs, streams opened by server have even IDs
+func NewMuxSession(conn net.Conn, client bool, config *MuxConfig) *MuxSession {
+	s := &MuxSession{
+		conn:     conn,
+		config:   config.withDefaults(),
+		streams:  map[uint32]*MuxStream{},
+		nextID:   2,
+		die:      make(chan struct{}),
+		lastRecv: time.Now().UnixNano(),
+	}
+	if client {
+		s.nextID = 1
+	}
+	s.accepts = make(chan *MuxStream, s.config.AcceptBacklog)
+	go s.recvLoop()
+	go s.keepAlive()
+	return s
+}
+
+// OpenStream opens a new stream
+func (s *MuxSession) OpenStream() (*MuxStream, error) {
+	s.lock.Lock()
+	if s.IsClosed() {
+		s.lock.Unlock()
+		return nil, ErrMuxSessionClosed
+	}
+	st := newMuxStream(s.nextID, s)
+	s.nextID += 2
+	s.streams[st.id] = st
+	s.lock.Unlock()
+	if err := s.writeFrame(muxCmdSYN, st.id, nil); err != nil {
+		s.removeStream(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream waits for a stream opened by peer
+func (s *MuxSession) AcceptStream() (*MuxStream, error) {
+	select {
+	case st := <-s.accepts:
+		return st, nil
+	case <-s.die:
+		return nil, s.closeErr()
+	}
+}
+
+// NumStreams returns number of open streams
+func (s *MuxSession) NumStreams() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.streams)
+}
+
+// IsClosed returns true if session is closed
+func (s *MuxSession) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes session, underlying net.Conn and all streams
+func (s *MuxSession) Close() error {
+	s.closeWithError(ErrMuxSessionClosed)
+	return nil
+}
+
+func (s *MuxSession) closeWithError(err error) {
+	s.dieOnce.Do(func() {
+		s.lock.Lock()
+		s.err = err
+		s.lock.Unlock()
+		close(s.die)
+		s.conn.Close()
+	})
+}
+
+func (s *MuxSession) closeErr() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+func (s *MuxSession) stream(id uint32) *MuxStream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.streams[id]
+}
+
+func (s *MuxSession) removeStream(id uint32) {
+	s.lock.Lock()
+	delete(s.streams, id)
+	s.lock.Unlock()
+}
+
+// writeFrame writes a frame as a whole
+func (s *MuxSession) writeFrame(cmd byte, id uint32, payload []byte) error {
+	b := make([]byte, muxHeaderSize+len(payload))
+	b[0] = cmd
+	binary.BigEndian.PutUint32(b[1:], id)
+	binary.BigEndian.PutUint16(b[5:], uint16(len(payload)))
+	copy(b[muxHeaderSize:], payload)
+
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+	if s.IsClosed() {
+		return s.closeErr()
+	}
+	if _, err := s.conn.Write(b); err != nil {
+		s.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+// recvLoop reads frames and dispatches them to streams, until session is closed
+func (s *MuxSession) recvLoop() {
+	hdr := make([]byte, muxHeaderSize)
+	for {
+		if _, err := io.ReadFull(s.conn, hdr); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+		cmd := hdr[0]
+		id := binary.BigEndian.Uint32(hdr[1:])
+		payload := make([]byte, binary.BigEndian.Uint16(hdr[5:]))
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.closeWithError(err)
+			return
+		}
+
+		switch cmd {
+		case muxCmdNOP:
+		case muxCmdSYN:
+			s.lock.Lock()
+			if s.streams[id] != nil {
+				s.lock.Unlock()
+				continue
+			}
+			st := newMuxStream(id, s)
+			s.streams[id] = st
+			s.lock.Unlock()
+			select {
+			case s.accepts <- st:
+			default:
+				// backlog is full, reset without blocking other streams
+				s.removeStream(id)
+				go s.writeFrame(muxCmdRST, id, nil)
+			}
+		case muxCmdPSH:
+			// frames of closed streams are dropped
+			if st := s.stream(id); st != nil && !st.push(payload) {
+				// peer ignores flow control
+				s.closeWithError(ErrMuxBadFrame)
+				return
+			}
+		case muxCmdUPD:
+			if len(payload) != 4 {
+				s.closeWithError(ErrMuxBadFrame)
+				return
+			}
+			if st := s.stream(id); st != nil {
+				st.update(binary.BigEndian.Uint32(payload))
+			}
+		case muxCmdFIN:
+			if st := s.stream(id); st != nil {
+				st.finish(false)
+			}
+		case muxCmdRST:
+			if st := s.stream(id); st != nil {
+				st.finish(true)
+				s.removeStream(id)
+			}
+		default:
+			s.closeWithError(ErrMuxBadFrame)
+			return
+		}
+	}
+}
+
+// keepAlive sends keepalive frames, and closes session if peer is silent for KeepAliveTimeout
+func (s *MuxSession) keepAlive() {
+	ticker := time.NewTicker(s.config.KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&s.lastRecv))) > s.config.KeepAliveTimeout {
+				s.closeWithError(ErrMuxTimeout)
+				return
+			}
+			s.writeFrame(muxCmdNOP, 0, nil)
+		case <-s.die:
+			return
+		}
+	}
+}
+
+// MuxStream a logical stream of MuxSession, implements net.Conn
+type MuxStream struct {
+	id      uint32
+	session *MuxSession
+
+	lock sync.Mutex
+	buf  bytes.Buffer
+	// bytes consumed by reader, and last reported to peer
+	read     uint32
+	reported uint32
+	// bytes sent, and consumed by peer
+	sent  uint32
+	acked uint32
+
+	finRecv bool
+	finSent bool
+	reset   bool
+	closed  bool
+
+	rdeadline time.Time
+	wdeadline time.Time
+	rnotify   chan struct{}
+	wnotify   chan struct{}
+}
+
+func newMuxStream(id uint32, s *MuxSession) *MuxStream {
+	return &MuxStream{
+		id:      id,
+		session: s,
+		rnotify: make(chan struct{}, 1),
+		wnotify: make(chan struct{}, 1),
+	}
+}
+
+// notify wakes up a waiting reader or writer
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait waits for notification until deadline or session closed
+func (st *MuxStream) wait(ch chan struct{}, deadline time.Time, op string) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return &net.OpError{Op: op, Net: "mux", Err: errTimeout{}}
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return &net.OpError{Op: op, Net: "mux", Err: errTimeout{}}
+	case <-st.session.die:
+		return st.session.closeErr()
+	}
+}
+
+// ID returns stream ID
+func (st *MuxStream) ID() uint32 {
+	return st.id
+}
+
+// push buffers data from peer, returns false if unread data exceeds StreamWindow
+func (st *MuxStream) push(b []byte) bool {
+	st.lock.Lock()
+	if st.buf.Len()+len(b) > int(st.session.config.StreamWindow) {
+		st.lock.Unlock()
+		return false
+	}
+	if !st.closed {
+		st.buf.Write(b)
+	}
+	st.lock.Unlock()
+	notify(st.rnotify)
+	return true
+}
+
+func (st *MuxStream) update(acked uint32) {
+	st.lock.Lock()
+	st.acked = acked
+	st.lock.Unlock()
+	notify(st.wnotify)
+}
+
+func (st *MuxStream) finish(reset bool) {
+	st.lock.Lock()
+	st.finRecv = true
+	if reset {
+		st.reset = true
+	}
+	st.lock.Unlock()
+	notify(st.rnotify)
+	notify(st.wnotify)
+}
+
+// Read reads data, returns io.EOF after peer shuts down writing
+func (st *MuxStream) Read(b []byte) (int, error) {
+	for {
+		st.lock.Lock()
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(b)
+			st.read += uint32(n)
+			var update []byte
+			if st.read-st.reported >= st.session.config.StreamWindow/2 && !st.finRecv {
+				st.reported = st.read
+				update = make([]byte, 4)
+				binary.BigEndian.PutUint32(update, st.read)
+			}
+			st.lock.Unlock()
+			if update != nil {
+				st.session.writeFrame(muxCmdUPD, st.id, update)
+			}
+			return n, nil
+		}
+		if st.closed {
+			st.lock.Unlock()
+			return 0, ErrMuxStreamClosed
+		}
+		if st.finRecv {
+			st.lock.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.rdeadline
+		st.lock.Unlock()
+		if err := st.wait(st.rnotify, deadline, "read"); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write writes data in frames, blocks if receive window of peer is full
+func (st *MuxStream) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		st.lock.Lock()
+		if st.reset {
+			st.lock.Unlock()
+			return n, ErrMuxStreamReset
+		}
+		if st.closed || st.finSent {
+			st.lock.Unlock()
+			return n, ErrMuxStreamClosed
+		}
+		window := st.session.config.StreamWindow - (st.sent - st.acked)
+		if window == 0 {
+			deadline := st.wdeadline
+			st.lock.Unlock()
+			if err := st.wait(st.wnotify, deadline, "write"); err != nil {
+				return n, err
+			}
+			continue
+		}
+		size := len(b)
+		if size > int(window) {
+			size = int(window)
+		}
+		if size > muxMaxFrameSize {
+			size = muxMaxFrameSize
+		}
+		st.sent += uint32(size)
+		st.lock.Unlock()
+		if err := st.session.writeFrame(muxCmdPSH, st.id, b[:size]); err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+// CloseWrite shuts down writing side, peer reads io.EOF
+func (st *MuxStream) CloseWrite() error {
+	st.lock.Lock()
+	if st.closed || st.finSent {
+		st.lock.Unlock()
+		return nil
+	}
+	st.finSent = true
+	st.lock.Unlock()
+	return st.session.writeFrame(muxCmdFIN, st.id, nil)
+}
+
+// Close closes stream, peer is reset unless both sides have shut down writing
+func (st *MuxStream) Close() error {
+	st.lock.Lock()
+	if st.closed {
+		st.lock.Unlock()
+		return nil
+	}
+	st.closed = true
+	done := st.finSent && st.finRecv
+	st.buf.Reset()
+	st.lock.Unlock()
+	notify(st.rnotify)
+	notify(st.wnotify)
+	st.session.removeStream(st.id)
+	if done || st.session.IsClosed() {
+		return nil
+	}
+	return st.session.writeFrame(muxCmdRST, st.id, nil)
+}
+
+// LocalAddr returns local address of session
+func (st *MuxStream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+// RemoteAddr returns remote address of session
+func (st *MuxStream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+// SetDeadline sets both read and write deadlines
+func (st *MuxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets read deadline, wakes up blocked Read
+func (st *MuxStream) SetReadDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.rdeadline = t
+	st.lock.Unlock()
+	notify(st.rnotify)
+	return nil
+}
+
+// SetWriteDeadline sets write deadline, wakes up Write blocked by flow control
+func (st *MuxStream) SetWriteDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.wdeadline = t
+	st.lock.Unlock()
+	notify(st.wnotify)
+	return nil
+}
+
+// MuxDialer dials targets as streams of shared MuxSession, implements ProxyDialer
+// UDP is not multiplexed, ListenPacket is delegated to Dialer
+type MuxDialer struct {
+	// dialer of FleeGrid server, usually a *Dialer
+	Dialer ProxyDialer
+	// options of sessions
+	Config *MuxConfig
+	// max streams of a session, a new session is created if all sessions are full
+	MaxStreams int
+
+	lock     sync.Mutex
+	sessions []*MuxSession
+}
+
+// NewMuxDialer create a new MuxDialer through FleeGrid server of Config
+func NewMuxDialer(config *Config) (*MuxDialer, error) {
+	d, err := NewDialer(config)
+	if err != nil {
+		return nil, err
+	}
+	return &MuxDialer{Dialer: d}, nil
+}
+
+// session returns a session with free capacity, creates one if needed
+// server is dialed without lock, so concurrent callers may create more sessions than needed
+func (d *MuxDialer) session(ctx context.Context) (*MuxSession, error) {
+	if s := d.freeSession(); s != nil {
+		return s, nil
+	}
+	conn, err := d.Dialer.DialContext(ctx, "tcp", MuxAddress)
+	if err != nil {
+		return nil, err
+	}
+	s := NewMuxSession(conn, true, d.Config)
+	d.lock.Lock()
+	d.sessions = append(d.sessions, s)
+	d.lock.Unlock()
+	return s, nil
+}
+
+// freeSession returns a session with free capacity, drops closed sessions
+func (d *MuxDialer) freeSession() *MuxSession {
+	max := d.MaxStreams
+	if max == 0 {
+		max = DefaultMuxMaxStreams
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	sessions := d.sessions[:0]
+	for _, s := range d.sessions {
+		if !s.IsClosed() {
+			sessions = append(sessions, s)
+		}
+	}
+	d.sessions = sessions
+	for _, s := range d.sessions {
+		if s.NumStreams() < max {
+			return s
+		}
+	}
+	return nil
+}
+
+// Dial see DialContext
+func (d *MuxDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext opens a stream to target
+func (d *MuxDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	target, err := ParseAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	s, err := d.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	st, err := s.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = st.Write(target); err != nil {
+		st.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// ListenPacket see Dialer.ListenPacket
+func (d *MuxDialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	return d.Dialer.ListenPacket(ctx)
+}
+
+// Close closes all sessions
+func (d *MuxDialer) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, s := range d.sessions {
+		s.Close()
+	}
+	d.sessions = nil
+	return nil
+}
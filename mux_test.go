@@ -0,0 +1,254 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const muxServerAddr = ":12332"
+const muxEchoAddr = ":12333"
+
+// createTestMuxSessions creates a pair of connected MuxSession
+func createTestMuxSessions(config *MuxConfig) (*MuxSession, *MuxSession) {
+	c1, c2 := net.Pipe()
+	return NewMuxSession(c1, true, config), NewMuxSession(c2, false, config)
+}
+
+func TestMuxSession(t *testing.T) {
+	client, server := createTestMuxSessions(&MuxConfig{StreamWindow: 4096})
+	defer client.Close()
+	defer server.Close()
+
+	// server echoes every stream
+	go func() {
+		for {
+			st, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer st.Close()
+				io.Copy(st, st)
+				st.CloseWrite()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := client.OpenStream()
+			if err != nil {
+				t.Errorf("Cannot open stream: %v", err)
+				return
+			}
+			defer st.Close()
+			if st.ID()%2 != 1 {
+				t.Errorf("Client stream ID should be odd: %d", st.ID())
+			}
+			// larger than window, requires window updates
+			str := []byte(randomPayloadString())
+			go func() {
+				st.Write(str)
+				st.CloseWrite()
+			}()
+			res, err := ioutil.ReadAll(st)
+			if err != nil {
+				t.Errorf("Failed to read: %v", err)
+				return
+			}
+			if !bytes.Equal(res, str) {
+				t.Error("Str mismatch")
+			}
+		}()
+	}
+	wg.Wait()
+
+	// write after CloseWrite
+	st, _ := client.OpenStream()
+	st.CloseWrite()
+	if _, err := st.Write([]byte("hello")); err != ErrMuxStreamClosed {
+		t.Fatal("Should fail to write after CloseWrite")
+	}
+	if _, err := ioutil.ReadAll(st); err != nil {
+		t.Fatalf("Should read EOF: %v", err)
+	}
+	st.Close()
+
+	// read deadline
+	st, _ = client.OpenStream()
+	st.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := st.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Should timeout")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Should be a timeout error: %v", err)
+	}
+	st.Close()
+
+	// streams are removed after closed
+	time.Sleep(50 * time.Millisecond)
+	if n := client.NumStreams(); n != 0 {
+		t.Fatalf("Client should have no stream, got %d", n)
+	}
+	if n := server.NumStreams(); n != 0 {
+		t.Fatalf("Server should have no stream, got %d", n)
+	}
+
+	// session closed
+	client.Close()
+	if _, err := client.OpenStream(); err != ErrMuxSessionClosed {
+		t.Fatal("Should fail to open stream on closed session")
+	}
+	if _, err := server.AcceptStream(); err == nil {
+		t.Fatal("Should fail to accept on closed session")
+	}
+}
+
+func TestMuxStreamReset(t *testing.T) {
+	client, server := createTestMuxSessions(nil)
+	defer client.Close()
+	defer server.Close()
+
+	st, _ := client.OpenStream()
+	st.Write([]byte("hello"))
+	sst, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("Cannot accept stream: %v", err)
+	}
+	st.Close()
+
+	// buffered data is still readable after reset
+	res, err := ioutil.ReadAll(sst)
+	if err != nil || string(res) != "hello" {
+		t.Fatalf("Failed to read: %q %v", res, err)
+	}
+	if _, err = sst.Write([]byte("world")); err != ErrMuxStreamReset {
+		t.Fatalf("Should fail to write to reset stream: %v", err)
+	}
+}
+
+func TestMuxKeepAlive(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	// peer reads but never sends anything
+	go io.Copy(ioutil.Discard, c2)
+	s := NewMuxSession(c1, true, &MuxConfig{KeepAliveInterval: 20 * time.Millisecond, KeepAliveTimeout: 50 * time.Millisecond})
+	if _, err := s.AcceptStream(); err != ErrMuxTimeout {
+		t.Fatalf("Should close by keepalive timeout: %v", err)
+	}
+}
+
+// writeTestMuxFrame writes a raw mux frame
+func writeTestMuxFrame(w io.Writer, cmd byte, id uint32, payload []byte) error {
+	b := make([]byte, muxHeaderSize, muxHeaderSize+len(payload))
+	b[0] = cmd
+	binary.BigEndian.PutUint32(b[1:], id)
+	binary.BigEndian.PutUint16(b[5:], uint16(len(payload)))
+	_, err := w.Write(append(b, payload...))
+	return err
+}
+
+func TestMuxStreamWindowExceeded(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go io.Copy(ioutil.Discard, c2)
+	s := NewMuxSession(c1, false, &MuxConfig{StreamWindow: 1024})
+	writeTestMuxFrame(c2, muxCmdSYN, 1, nil)
+	if _, err := s.AcceptStream(); err != nil {
+		t.Fatalf("Cannot accept stream: %v", err)
+	}
+	// peer ignores window, session is closed
+	for i := 0; i < 3; i++ {
+		if writeTestMuxFrame(c2, muxCmdPSH, 1, make([]byte, 512)) != nil {
+			break
+		}
+	}
+	if _, err := s.AcceptStream(); err != ErrMuxBadFrame {
+		t.Fatalf("Should close on exceeded window: %v", err)
+	}
+}
+
+func TestMuxAcceptBacklogFull(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s := NewMuxSession(c1, false, &MuxConfig{AcceptBacklog: 1})
+	defer s.Close()
+	go func() {
+		writeTestMuxFrame(c2, muxCmdSYN, 1, nil)
+		writeTestMuxFrame(c2, muxCmdSYN, 3, nil)
+	}()
+	// the second stream is reset instead of blocking the session
+	hdr := make([]byte, muxHeaderSize)
+	if _, err := io.ReadFull(c2, hdr); err != nil {
+		t.Fatalf("Cannot read frame: %v", err)
+	}
+	if hdr[0] != muxCmdRST || binary.BigEndian.Uint32(hdr[1:]) != 3 {
+		t.Fatalf("Should reset stream 3, got cmd %d stream %d", hdr[0], binary.BigEndian.Uint32(hdr[1:]))
+	}
+	if st, err := s.AcceptStream(); err != nil || st.ID() != 1 {
+		t.Fatalf("Should accept stream 1: %v", err)
+	}
+	if s.NumStreams() != 1 {
+		t.Fatalf("Should have 1 stream, got %d", s.NumStreams())
+	}
+}
+
+func TestMuxDialer(t *testing.T) {
+	config, _ := ParseConfigFromURL("flee://hello@127.0.0.1" + muxServerAddr)
+
+	echo := startTestEchoServer(t, muxEchoAddr)
+	defer echo.Close()
+
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("Cannot create Server: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1"+muxServerAddr)
+	if err != nil {
+		t.Fatalf("Cannot listen socket: %v", err)
+	}
+	defer l.Close()
+	go s.Serve(l)
+
+	d, err := NewMuxDialer(config)
+	if err != nil {
+		t.Fatalf("Cannot create MuxDialer: %v", err)
+	}
+	defer d.Close()
+	d.MaxStreams = 2
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := d.Dial("tcp", "127.0.0.1"+muxEchoAddr)
+		if err != nil {
+			t.Fatalf("Cannot dial: %v", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		str := randomPayloadString()
+		go conn.Write([]byte(str))
+		res := make([]byte, len(str))
+		if _, err = io.ReadFull(conn, res); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if string(res) != str {
+			t.Fatal("Str mismatch")
+		}
+	}
+	d.lock.Lock()
+	sessions := len(d.sessions)
+	d.lock.Unlock()
+	if sessions != 2 {
+		t.Fatalf("Should create 2 sessions for 3 streams, got %d", sessions)
+	}
+}
@@ -14,6 +14,9 @@ const PacketMaxSize = 64 * 1024
 // ErrPacketTooShort packet is too short for a valid encrypted packet
 var ErrPacketTooShort = errors.New("short packet")
 
+// ErrPacketTooLarge packet is too large to send
+var ErrPacketTooLarge = errors.New("packet too large")
+
 // all zero nonce for packet protocol
 var _zeroNonce [128]byte
 
@@ -64,6 +67,23 @@ type PacketConn struct {
 	Cipher
 	sync.Mutex
 	buf []byte
+	// for multi-user PacketConn
+	users *MultiUserCipher
+	peers map[string]*userCipher
+	plock sync.Mutex
+	rbuf  []byte
+	rlock sync.Mutex
+	// for session packets
+	session       bool
+	acceptSession bool
+	sealers       map[Cipher]*packetSealer
+	openers       packetOpeners
+	speers        map[string]bool
+	// traffic accounting
+	meter meter
+	// rate limiting
+	limiters     []*Limiter
+	userLimiters *UserLimiters
 }
 
 // NewPacketConn wraps a net.PacketConn with Cipher
@@ -71,24 +91,104 @@ func NewPacketConn(conn net.PacketConn, c Cipher) (*PacketConn, error) {
 	return &PacketConn{PacketConn: conn, Cipher: c, buf: make([]byte, PacketMaxSize)}, nil
 }
 
+// SetStats aggregates traffic of this PacketConn to Stats, and enforces quota by dropping packets
+// should be called before first ReadFrom or WriteTo
+func (c *PacketConn) SetStats(s *Stats) {
+	c.meter.stats = s
+}
+
+// SetLimiters limits read and write throughput with Limiter, limiters can be shared
+// should be called before first ReadFrom or WriteTo
+func (c *PacketConn) SetLimiters(ls ...*Limiter) {
+	c.limiters = ls
+}
+
+// SetUserLimiters limits read and write throughput with Limiter of user
+// should be called before first ReadFrom or WriteTo
+func (c *PacketConn) SetUserLimiters(u *UserLimiters) {
+	c.userLimiters = u
+}
+
+// Stats returns traffic counters of this PacketConn
+func (c *PacketConn) Stats() StatsSnapshot {
+	return c.meter.Snapshot()
+}
+
 // WriteTo encrypts bytes and writes to underlaying net.PacketConn
 func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	var ciph Cipher = c
+	var user string
+	if c.users != nil {
+		u, ok := c.peerCipher(addr)
+		if !ok {
+			return 0, ErrNoMatchingUser
+		}
+		ciph, user = u, u.user
+	}
+	if err := c.meter.allow(user); err != nil {
+		return 0, err
+	}
+	session := c.session || (c.acceptSession && c.sessionPeer(addr.String()))
+	// throttled without lock, so a throttled user does not block others, tag size is assumed to be 16
+	size := ciph.SaltSize() + len(b) + 16
+	if session {
+		size += packetCounterSize
+	}
+	waitAll(c.userLimiters.limitersOf(c.limiters, user), size)
 	c.Lock()
 	defer c.Unlock()
-	buf, err := SealPacket(c.buf, b, c)
+	var buf []byte
+	var err error
+	if session {
+		var s *packetSealer
+		if s, err = c.packetSealerOf(ciph); err == nil {
+			buf, err = s.seal(c.buf, b)
+		}
+	} else {
+		buf, err = SealPacket(c.buf, b, ciph)
+	}
 	if err != nil {
 		return 0, err
 	}
 	_, err = c.PacketConn.WriteTo(buf, addr)
+	if err == nil {
+		c.meter.out(user, len(b))
+		currentMetrics().packetOut(cipherName(ciph), len(b))
+	}
 	return len(b), err
 }
 
 // ReadFrom reads from underlaying net.PacketConn and decrypts
 func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
-	n, addr, err := c.PacketConn.ReadFrom(b)
-	if err != nil {
+	if c.users != nil {
+		n, addr, _, err := c.ReadFromUser(b)
 		return n, addr, err
 	}
-	b, err = OpenPacket(b, b[:n], c)
-	return len(b), addr, err
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+	if c.rbuf == nil {
+		c.rbuf = make([]byte, PacketMaxSize)
+	}
+	n, addr, err := c.PacketConn.ReadFrom(c.rbuf)
+	if err != nil {
+		return 0, addr, err
+	}
+	// a failed trial may clear dst, so it must not overlap the packet
+	p, _, session, err := c.openPacket(b, c.rbuf[:n])
+	if err != nil {
+		if err != io.ErrShortBuffer && err != ErrPacketTooShort && err != ErrPacketReplayed {
+			c.meter.authFailure("")
+			currentMetrics().authFailure()
+		}
+		return 0, addr, err
+	}
+	waitAll(c.userLimiters.limitersOf(c.limiters, ""), n)
+	currentMetrics().packetIn(cipherName(c.Cipher), len(p))
+	if err = c.meter.in("", len(p)); err != nil {
+		return 0, addr, err
+	}
+	if c.acceptSession {
+		c.setSessionPeer(addr.String(), session)
+	}
+	return len(p), addr, nil
 }
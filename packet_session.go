@@ -0,0 +1,316 @@
+package core
+
+import (
+	"container/list"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// packetCounterSize bytes of packet counter following salt in session packets
+const packetCounterSize = 8
+
+// PacketSessionCacheSize maximum number of sessions remembered by a PacketConn for receiving
+// replay protection is best-effort, it only lasts while a session is remembered,
+// packets of a session evicted from cache are accepted again, so it should exceed active sessions
+var PacketSessionCacheSize = 1024
+
+// PacketSessionLimit packets sealed in a session before a new salt is chosen
+var PacketSessionLimit uint64 = 1 << 24
+
+// packetReplayWindow number of packet counters below the highest one tracked for replay
+const packetReplayWindow = 64
+
+// ErrPacketReplayed packet counter of a remembered session is seen already or too old
+var ErrPacketReplayed = errors.New("packet replayed")
+
+// packetSealer seals packets of a session
+// salt and AEAD are created once, packets are numbered by a counter used as nonce
+//
+//	[salt][counter, 8 bytes little-endian][encrypted payload][tag]
+type packetSealer struct {
+	salt    []byte
+	aead    cipher.AEAD
+	counter uint64
+}
+
+// newPacketSealer create a packetSealer with a random salt
+func newPacketSealer(ciph Cipher) (*packetSealer, error) {
+	salt := make([]byte, ciph.SaltSize())
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	a, err := ciph.CreateAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	return &packetSealer{salt: salt, aead: a}, nil
+}
+
+// seal encrypts a session packet
+func (s *packetSealer) seal(dst, plain []byte) ([]byte, error) {
+	saltSize := len(s.salt)
+	head := saltSize + packetCounterSize
+	if len(dst) < head+len(plain)+s.aead.Overhead() {
+		return nil, io.ErrShortBuffer
+	}
+	copy(dst, s.salt)
+	binary.LittleEndian.PutUint64(dst[saltSize:head], s.counter)
+	var nonce [24]byte
+	copy(nonce[:], dst[saltSize:head])
+	s.counter++
+	b := s.aead.Seal(dst[head:head], nonce[:s.aead.NonceSize()], plain, nil)
+	return dst[:head+len(b)], nil
+}
+
+// expired reports whether a new salt should be chosen
+func (s *packetSealer) expired() bool {
+	return s.counter >= PacketSessionLimit
+}
+
+// packetOpener opens packets of a session, with a sliding window against replay
+type packetOpener struct {
+	salt string
+	aead cipher.AEAD
+	user *userCipher
+	// highest counter seen plus one, and bitmap of counters seen below it
+	next   uint64
+	window uint64
+}
+
+// open decrypts a session packet, src starts with salt, dst must not overlap src
+func (o *packetOpener) open(dst, src []byte) ([]byte, uint64, error) {
+	head := len(o.salt) + packetCounterSize
+	if len(src) < head+o.aead.Overhead() {
+		return nil, 0, ErrPacketTooShort
+	}
+	if head+len(dst)+o.aead.Overhead() < len(src) {
+		return nil, 0, io.ErrShortBuffer
+	}
+	var nonce [24]byte
+	copy(nonce[:], src[len(o.salt):head])
+	b, err := o.aead.Open(dst[:0], nonce[:o.aead.NonceSize()], src[head:], nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return b, binary.LittleEndian.Uint64(nonce[:]), nil
+}
+
+// accept marks counter seen, returns false if it is seen already or too old
+func (o *packetOpener) accept(counter uint64) bool {
+	if counter >= o.next {
+		if shift := counter - o.next + 1; shift >= packetReplayWindow {
+			o.window = 0
+		} else {
+			o.window <<= shift
+		}
+		o.window |= 1
+		o.next = counter + 1
+		return true
+	}
+	d := o.next - 1 - counter
+	if d >= packetReplayWindow || o.window&(1<<d) != 0 {
+		return false
+	}
+	o.window |= 1 << d
+	return true
+}
+
+// packetOpeners bounded LRU cache of packetOpener by salt
+type packetOpeners struct {
+	sync.Mutex
+	lru   *list.List
+	index map[string]*list.Element
+	// salt sizes of remembered sessions, ciphers of multiple users may differ
+	sizes []int
+}
+
+// get returns packetOpener of the salt src starts with, and moves it to front
+func (p *packetOpeners) get(src []byte) *packetOpener {
+	p.Lock()
+	defer p.Unlock()
+	for _, size := range p.sizes {
+		if len(src) < size {
+			continue
+		}
+		if e, ok := p.index[string(src[:size])]; ok {
+			p.lru.MoveToFront(e)
+			return e.Value.(*packetOpener)
+		}
+	}
+	return nil
+}
+
+// add remembers a packetOpener, evicts the least recently used one if full
+func (p *packetOpeners) add(o *packetOpener) {
+	p.Lock()
+	defer p.Unlock()
+	if p.index == nil {
+		p.lru, p.index = list.New(), map[string]*list.Element{}
+	}
+	if e, ok := p.index[o.salt]; ok {
+		// replaces session of a user added again
+		p.lru.Remove(e)
+		delete(p.index, o.salt)
+	}
+	if p.lru.Len() >= PacketSessionCacheSize {
+		if e := p.lru.Back(); e != nil {
+			delete(p.index, p.lru.Remove(e).(*packetOpener).salt)
+		}
+	}
+	p.index[o.salt] = p.lru.PushFront(o)
+	for _, size := range p.sizes {
+		if size == len(o.salt) {
+			return
+		}
+	}
+	p.sizes = append(p.sizes, len(o.salt))
+}
+
+// accept marks counter of a packetOpener seen, see packetOpener.accept
+func (p *packetOpeners) accept(o *packetOpener, counter uint64) bool {
+	p.Lock()
+	defer p.Unlock()
+	return o.accept(counter)
+}
+
+// openAnyPacket decrypts a packet of ciph, a classic packet, or the first packet of a session if session is true
+// the packetOpener is returned for a session packet, dst must not overlap src
+func openAnyPacket(dst, src []byte, ciph Cipher, session bool) ([]byte, *packetOpener, error) {
+	saltSize := ciph.SaltSize()
+	if len(src) < saltSize {
+		return nil, nil, ErrPacketTooShort
+	}
+	a, err := ciph.CreateAEAD(src[:saltSize])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(src) < saltSize+a.Overhead() {
+		return nil, nil, ErrPacketTooShort
+	}
+	if saltSize+len(dst)+a.Overhead() < len(src) {
+		return nil, nil, io.ErrShortBuffer
+	}
+	b, err := a.Open(dst[:0], _zeroNonce[:a.NonceSize()], src[saltSize:], nil)
+	if err == nil || !session {
+		return b, nil, err
+	}
+	// same subkey, try as session packet
+	o := &packetOpener{salt: string(src[:saltSize]), aead: a}
+	b, counter, serr := o.open(dst, src)
+	if serr != nil {
+		return nil, nil, err
+	}
+	o.accept(counter)
+	return b, o, nil
+}
+
+// openPacket decrypts a classic or session packet, sessions are remembered for following packets
+// returns user for multi-user PacketConn, and whether it is a session packet, dst must not overlap src
+func (c *PacketConn) openPacket(dst, src []byte) ([]byte, *userCipher, bool, error) {
+	if !c.acceptSession {
+		if c.users != nil {
+			b, u, _, err := c.users.openPacket(dst, src, false)
+			return b, u, false, err
+		}
+		b, _, err := openAnyPacket(dst, src, c.Cipher, false)
+		return b, nil, false, err
+	}
+	if o := c.openers.get(src); o != nil && (o.user == nil || c.users.has(o.user)) {
+		b, counter, err := o.open(dst, src)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if !c.openers.accept(o, counter) {
+			return nil, nil, false, ErrPacketReplayed
+		}
+		return b, o.user, true, nil
+	}
+	var b []byte
+	var u *userCipher
+	var o *packetOpener
+	var err error
+	if c.users != nil {
+		b, u, o, err = c.users.openPacket(dst, src, true)
+	} else {
+		b, o, err = openAnyPacket(dst, src, c.Cipher, true)
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if o != nil {
+		o.user = u
+		c.openers.add(o)
+	}
+	return b, u, o != nil, nil
+}
+
+// packetSealerOf returns packetSealer of ciph, a new session is started after PacketSessionLimit packets
+// should be called with PacketConn locked
+func (c *PacketConn) packetSealerOf(ciph Cipher) (*packetSealer, error) {
+	if s, ok := c.sealers[ciph]; ok && !s.expired() {
+		return s, nil
+	}
+	s, err := newPacketSealer(ciph)
+	if err != nil {
+		return nil, err
+	}
+	if c.sealers == nil || len(c.sealers) >= PacketSessionCacheSize {
+		// ciphers of users added again are dropped
+		c.sealers = map[Cipher]*packetSealer{}
+	}
+	c.sealers[ciph] = s
+	return s, nil
+}
+
+// SetPacketSession sends packets in sessions, salt is chosen once per session and packets are numbered
+// the receiver must accept session packets, subkey derivation is saved for each packet
+// enabling it accepts session packets as well, see AcceptPacketSession
+// should be called before first ReadFrom or WriteTo
+func (c *PacketConn) SetPacketSession(on bool) {
+	c.session = on
+	if on {
+		c.acceptSession = true
+	}
+}
+
+// AcceptPacketSession accepts session packets besides classic ones, replies to peers sending them are sent in sessions
+// a packet failing as classic one is tried again as session packet, doubling cost of trial decryption
+// should be called before first ReadFrom or WriteTo
+func (c *PacketConn) AcceptPacketSession(on bool) {
+	c.acceptSession = on
+}
+
+// sessionPeer reports whether addr sent session packets recently, replies to it are sent in sessions
+func (c *PacketConn) sessionPeer(addr string) bool {
+	c.plock.Lock()
+	defer c.plock.Unlock()
+	return c.speers[addr]
+}
+
+// setSessionPeer remembers whether addr sent session packets
+func (c *PacketConn) setSessionPeer(addr string, on bool) {
+	c.plock.Lock()
+	defer c.plock.Unlock()
+	if on == c.speers[addr] {
+		return
+	}
+	if !on {
+		delete(c.speers, addr)
+		return
+	}
+	if c.speers == nil {
+		c.speers = map[string]bool{}
+	}
+	if len(c.speers) >= PacketSessionCacheSize {
+		// evict an arbitrary peer
+		for k := range c.speers {
+			delete(c.speers, k)
+			break
+		}
+	}
+	c.speers[addr] = true
+}
@@ -0,0 +1,204 @@
+package core
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+const packetSessionAddr = ":12338"
+
+func TestPacketReplayWindow(t *testing.T) {
+	var o packetOpener
+	for _, n := range []uint64{0, 2, 1, 100, 40, 99} {
+		if !o.accept(n) {
+			t.Fatalf("counter %d should be accepted", n)
+		}
+	}
+	// seen, and too old
+	for _, n := range []uint64{0, 2, 100, 40, 36} {
+		if o.accept(n) {
+			t.Fatalf("counter %d should be rejected", n)
+		}
+	}
+}
+
+func TestPacketSession(t *testing.T) {
+	c, err := NewCipher("AEAD_CHACHA20_POLY1305", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, _ := NewPacketConn(nil, c)
+	receiver, _ := NewPacketConn(nil, c)
+	receiver.AcceptPacketSession(true)
+	s, err := sender.packetSealerOf(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, PacketMaxSize)
+	dst := make([]byte, PacketMaxSize)
+	var packets [][]byte
+	for i := 0; i < 3; i++ {
+		plain := []byte(randomPacketString())
+		b, err := s.seal(buf, plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, append([]byte{}, b...))
+		p, _, session, err := receiver.openPacket(dst, b)
+		if err != nil || !session || !bytes.Equal(p, plain) {
+			t.Fatalf("should open session packet %d: %v", i, err)
+		}
+	}
+	// the session is remembered
+	if receiver.openers.lru.Len() != 1 {
+		t.Fatalf("should remember 1 session, got %d", receiver.openers.lru.Len())
+	}
+	// replayed
+	if _, _, _, err = receiver.openPacket(dst, packets[1]); err != ErrPacketReplayed {
+		t.Fatalf("should reject replayed packet, got %v", err)
+	}
+	// tampered counter
+	packets[2][c.SaltSize()]++
+	if _, _, _, err = receiver.openPacket(dst, packets[2]); err == nil {
+		t.Fatal("should reject tampered packet")
+	}
+	// classic packets are still accepted
+	b, _ := SealPacket(buf, []byte("classic"), c)
+	p, _, session, err := receiver.openPacket(dst, b)
+	if err != nil || session || string(p) != "classic" {
+		t.Fatalf("should open classic packet: %v", err)
+	}
+	// session packets are only accepted if enabled
+	classic, _ := NewPacketConn(nil, c)
+	b, _ = s.seal(buf, []byte("session"))
+	if _, _, _, err = classic.openPacket(dst, b); err == nil {
+		t.Fatal("should not accept session packet")
+	}
+}
+
+func TestPacketSessionCacheSize(t *testing.T) {
+	size := PacketSessionCacheSize
+	PacketSessionCacheSize = 2
+	defer func() { PacketSessionCacheSize = size }()
+
+	c, _ := NewCipher("AEAD_AES_128_GCM", "hello")
+	receiver, _ := NewPacketConn(nil, c)
+	receiver.AcceptPacketSession(true)
+	buf := make([]byte, PacketMaxSize)
+	dst := make([]byte, PacketMaxSize)
+	for i := 0; i < 5; i++ {
+		s, _ := newPacketSealer(c)
+		b, _ := s.seal(buf, []byte("hello"))
+		if _, _, _, err := receiver.openPacket(dst, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := receiver.openers.lru.Len(); n != 2 || len(receiver.openers.index) != 2 {
+		t.Fatalf("should remember 2 sessions, got %d", n)
+	}
+}
+
+func TestPacketConnSession(t *testing.T) {
+	m, ciphers := createTestUsers(t)
+
+	sn, err := net.ListenPacket("udp", "127.0.0.1"+packetSessionAddr)
+	if err != nil {
+		t.Fatal("Cannot listen socket")
+	}
+	sconn, _ := NewMultiUserPacketConn(sn, m)
+	sconn.AcceptPacketSession(true)
+	defer sconn.Close()
+
+	// server side, echo back with "user:" prefix, replies are sent in sessions
+	sessions := make(chan bool, 16)
+	go func() {
+		buf := make([]byte, PacketMaxSize)
+		for {
+			n, addr, user, err := sconn.ReadFromUser(buf)
+			if err != nil {
+				if err == ErrNoMatchingUser {
+					continue
+				}
+				break
+			}
+			sessions <- sconn.sessionPeer(addr.String())
+			sconn.WriteTo(append([]byte(user+":"), buf[:n]...), addr)
+		}
+	}()
+
+	for _, name := range []string{"bob", "alice"} {
+		cn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Cannot listen socket: %v", err)
+		}
+		cconn, _ := NewPacketConn(cn, ciphers[name])
+		cconn.SetPacketSession(true)
+		for i := 0; i < 3; i++ {
+			str := randomPacketString()
+			if _, err = cconn.WriteTo([]byte(str), sn.LocalAddr()); err != nil {
+				t.Fatalf("Can't write PacketConn:%v\n", err)
+			}
+			buf := make([]byte, PacketMaxSize)
+			n, _, err := cconn.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("Can't read PacketConn:%v\n", err)
+			}
+			if string(buf[:n]) != name+":"+str {
+				t.Fatal("str mismatch")
+			}
+			if !<-sessions {
+				t.Fatal("should receive session packets")
+			}
+		}
+		// server replied in a session too
+		if !cconn.sessionPeer(sn.LocalAddr().String()) {
+			t.Fatal("should reply in session")
+		}
+		cconn.Close()
+	}
+	// one session for each client
+	if n := sconn.openers.lru.Len(); n != 2 {
+		t.Fatalf("should remember 2 sessions, got %d", n)
+	}
+}
+
+func benchmarkPacket(b *testing.B, session bool) {
+	c, _ := NewCipher("AEAD_AES_256_GCM", "hello")
+	sender, _ := NewPacketConn(nil, c)
+	receiver, _ := NewPacketConn(nil, c)
+	receiver.AcceptPacketSession(true)
+	plain := make([]byte, 1200)
+	buf := make([]byte, PacketMaxSize)
+	dst := make([]byte, PacketMaxSize)
+	b.SetBytes(int64(len(plain)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var p []byte
+		var err error
+		if session {
+			var s *packetSealer
+			if s, err = sender.packetSealerOf(c); err == nil {
+				p, err = s.seal(buf, plain)
+			}
+		} else {
+			p, err = SealPacket(buf, plain, c)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, _, err = receiver.openPacket(dst, p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPacket(b *testing.B) {
+	benchmarkPacket(b, false)
+}
+
+func BenchmarkPacketSession(b *testing.B) {
+	benchmarkPacket(b, true)
+}
@@ -0,0 +1,54 @@
+package core
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// closeWriter is implemented by connections supporting half-close, like *net.TCPConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// CloseWrite shuts down writing side of underlying net.Conn if supported
+func (c *StreamConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// halfClose shuts down writing side of conn, or stops reading of it if half-close is not supported
+func halfClose(conn net.Conn) {
+	if cw, ok := conn.(closeWriter); ok {
+		cw.CloseWrite()
+	} else {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+// Relay copies data between left and right in both directions until both finish
+// returns bytes copied from right to left, left to right, and the first error
+func Relay(left, right net.Conn) (int64, int64, error) {
+	type result struct {
+		n   int64
+		err error
+	}
+	ch := make(chan result, 1)
+
+	go func() {
+		n, err := io.Copy(right, left)
+		halfClose(right)
+		ch <- result{n, err}
+	}()
+
+	n, err := io.Copy(left, right)
+	halfClose(left)
+	rs := <-ch
+
+	if err == nil {
+		err = rs.err
+	}
+	return n, rs.n, err
+}
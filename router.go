@@ -0,0 +1,481 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrBadRule rule is mal-formatted
+	ErrBadRule = errors.New("bad rule")
+	// ErrRouteRejected target is rejected by router
+	ErrRouteRejected = errors.New("rejected by router")
+	// ErrUnknownProxy route refers to a proxy not configured
+	ErrUnknownProxy = errors.New("unknown proxy")
+)
+
+// RouteAction action of a Route
+type RouteAction int
+
+// actions of Route
+const (
+	// connect through FleeGrid server
+	ActionProxy RouteAction = iota
+	// connect directly
+	ActionDirect
+	// reject connection
+	ActionReject
+)
+
+// Route result of routing
+type Route struct {
+	Action RouteAction
+	// name of proxy (Config.Name) for ActionProxy, empty for default proxy
+	Proxy string
+}
+
+func (r Route) String() string {
+	switch r.Action {
+	case ActionDirect:
+		return "direct"
+	case ActionReject:
+		return "reject"
+	}
+	if len(r.Proxy) > 0 {
+		return "proxy:" + r.Proxy
+	}
+	return "proxy"
+}
+
+// ParseRoute parse "proxy", "proxy:NAME", "direct" or "reject"
+func ParseRoute(s string) (Route, error) {
+	s = strings.TrimSpace(s)
+	switch strings.ToLower(s) {
+	case "proxy":
+		return Route{Action: ActionProxy}, nil
+	case "direct":
+		return Route{Action: ActionDirect}, nil
+	case "reject":
+		return Route{Action: ActionReject}, nil
+	}
+	if strings.HasPrefix(strings.ToLower(s), "proxy:") && len(s) > 6 {
+		return Route{Action: ActionProxy, Proxy: s[6:]}, nil
+	}
+	return Route{}, ErrBadRule
+}
+
+// Rule a routing rule
+type Rule struct {
+	// DOMAIN, DOMAIN-SUFFIX, DOMAIN-KEYWORD, DOMAIN-REGEX, IP-CIDR, PORT
+	Type  string
+	Value string
+	Route Route
+
+	match func(host string, ip net.IP, port int) bool
+}
+
+// NewRule create a Rule
+func NewRule(typ, value string, route Route) (*Rule, error) {
+	r := &Rule{Type: strings.ToUpper(typ), Value: value, Route: route}
+	switch r.Type {
+	case "DOMAIN":
+		v := strings.ToLower(value)
+		r.match = func(host string, ip net.IP, port int) bool {
+			return ip == nil && host == v
+		}
+	case "DOMAIN-SUFFIX":
+		v := strings.TrimPrefix(strings.ToLower(value), ".")
+		r.match = func(host string, ip net.IP, port int) bool {
+			return ip == nil && (host == v || strings.HasSuffix(host, "."+v))
+		}
+	case "DOMAIN-KEYWORD":
+		v := strings.ToLower(value)
+		r.match = func(host string, ip net.IP, port int) bool {
+			return ip == nil && strings.Contains(host, v)
+		}
+	case "DOMAIN-REGEX":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, ErrBadRule
+		}
+		r.match = func(host string, ip net.IP, port int) bool {
+			return ip == nil && re.MatchString(host)
+		}
+	case "IP-CIDR", "IP-CIDR6":
+		_, n, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, ErrBadRule
+		}
+		r.match = func(host string, ip net.IP, port int) bool {
+			return ip != nil && n.Contains(ip)
+		}
+	case "PORT":
+		lo, hi, err := parsePortRange(value)
+		if err != nil {
+			return nil, err
+		}
+		r.match = func(host string, ip net.IP, port int) bool {
+			return port >= lo && port <= hi
+		}
+	default:
+		return nil, ErrBadRule
+	}
+	return r, nil
+}
+
+// parsePortRange parse "PORT" or "LOW-HIGH"
+func parsePortRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	lo, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 16)
+	if err != nil {
+		return 0, 0, ErrBadRule
+	}
+	hi := lo
+	if len(parts) == 2 {
+		if hi, err = strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 16); err != nil || hi < lo {
+			return 0, 0, ErrBadRule
+		}
+	}
+	return int(lo), int(hi), nil
+}
+
+// Router matches destinations against rules in order
+// domains are matched as is, without DNS resolution, so IP-CIDR rules only match IP destinations
+type Router struct {
+	Rules []*Rule
+	// Final route when no rule matches, default to proxy
+	Final Route
+}
+
+// ParseRules parse rules, one rule per line
+// Format:
+//
+//	# comment
+//	DOMAIN-SUFFIX,example.com,direct
+//	DOMAIN-KEYWORD,ads,reject
+//	IP-CIDR,10.0.0.0/8,direct
+//	PORT,6881-6889,proxy:backup
+//	DOMAIN-REGEX,^ads[0-9]{1,3}\.,reject
+//	FINAL,proxy
+func ParseRules(r io.Reader) (*Router, error) {
+	router := &Router{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// type and route are the first and last fields, value in between may contain commas
+		first, last := strings.Index(line, ","), strings.LastIndex(line, ",")
+		if first < 0 {
+			return nil, ErrBadRule
+		}
+		typ := strings.TrimSpace(line[:first])
+		route, err := ParseRoute(strings.TrimSpace(line[last+1:]))
+		if err != nil {
+			return nil, err
+		}
+		if strings.ToUpper(typ) == "FINAL" && first == last {
+			router.Final = route
+			continue
+		}
+		if first == last {
+			return nil, ErrBadRule
+		}
+		rule, err := NewRule(typ, strings.TrimSpace(line[first+1:last]), route)
+		if err != nil {
+			return nil, err
+		}
+		router.Rules = append(router.Rules, rule)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return router, nil
+}
+
+// LoadRules load rules from file, see ParseRules
+func LoadRules(filename string) (*Router, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRules(f)
+}
+
+// Match returns route of a host:port address
+func (r *Router) Match(address string) Route {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	port, _ := strconv.Atoi(portStr)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	for _, rule := range r.Rules {
+		if rule.match(host, ip, port) {
+			return rule.Route
+		}
+	}
+	return r.Final
+}
+
+// DirectDialer dials targets directly, implements ProxyDialer
+type DirectDialer struct {
+	net.Dialer
+}
+
+// defaultDirectDialer used by RouteDialer without Direct, shared so packet conns of direct routes are reused
+var defaultDirectDialer = &DirectDialer{}
+
+// ListenPacket create a net.PacketConn sending to targets directly, WriteTo resolves host:port
+func (d *DirectDialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	var lc net.ListenConfig
+	pc, err := lc.ListenPacket(ctx, "udp", "")
+	if err != nil {
+		return nil, err
+	}
+	return &directPacketConn{PacketConn: pc}, nil
+}
+
+// directPacketConn resolves non-UDP addresses before writing
+type directPacketConn struct {
+	net.PacketConn
+}
+
+func (c *directPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if _, ok := addr.(*net.UDPAddr); !ok {
+		ua, err := net.ResolveUDPAddr("udp", addr.String())
+		if err != nil {
+			return 0, err
+		}
+		addr = ua
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// RouteDialer chooses between proxies, direct connection and rejection by Router, implements ProxyDialer
+type RouteDialer struct {
+	Router *Router
+	// proxies by name, "" for default proxy
+	Proxies map[string]ProxyDialer
+	// dialer for direct connections, default to DirectDialer
+	Direct ProxyDialer
+}
+
+// NewRouteDialer create a RouteDialer with proxies from Config, the first Config is the default proxy
+func NewRouteDialer(router *Router, configs ...*Config) (*RouteDialer, error) {
+	r := &RouteDialer{Router: router, Proxies: map[string]ProxyDialer{}, Direct: &DirectDialer{}}
+	for i, config := range configs {
+		d, err := NewDialer(config)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			r.Proxies[""] = d
+		}
+		if len(config.Name) > 0 {
+			r.Proxies[config.Name] = d
+		}
+	}
+	return r, nil
+}
+
+// dialerOf returns ProxyDialer for a target address
+func (r *RouteDialer) dialerOf(address string) (ProxyDialer, error) {
+	route := r.Router.Match(address)
+	switch route.Action {
+	case ActionReject:
+		return nil, ErrRouteRejected
+	case ActionDirect:
+		if r.Direct == nil {
+			return defaultDirectDialer, nil
+		}
+		return r.Direct, nil
+	}
+	d := r.Proxies[route.Proxy]
+	if d == nil {
+		return nil, ErrUnknownProxy
+	}
+	return d, nil
+}
+
+// DialContext dials target with the dialer chosen by Router
+func (r *RouteDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d, err := r.dialerOf(address)
+	if err != nil {
+		return nil, err
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+// ListenPacket create a net.PacketConn routing each datagram by its target
+func (r *RouteDialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	return &routePacketConn{
+		dialer:  r,
+		ctx:     ctx,
+		conns:   map[ProxyDialer]net.PacketConn{},
+		dchange: make(chan struct{}),
+		packets: make(chan routePacket, 16),
+		closed:  make(chan struct{}),
+	}, nil
+}
+
+// routePacket a datagram received by routePacketConn
+type routePacket struct {
+	b    []byte
+	addr net.Addr
+}
+
+// routePacketConn routes datagrams by target, and merges datagrams from all routes
+type routePacketConn struct {
+	dialer *RouteDialer
+	ctx    context.Context
+
+	lock      sync.Mutex
+	conns     map[ProxyDialer]net.PacketConn
+	deadline  time.Time
+	wdeadline time.Time
+	// closed and replaced when read deadline changes, wakes up blocked ReadFrom
+	dchange chan struct{}
+
+	packets chan routePacket
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// conn returns packet conn of a ProxyDialer, creates one if not existed
+func (c *routePacketConn) conn(d ProxyDialer) (net.PacketConn, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if pc := c.conns[d]; pc != nil {
+		return pc, nil
+	}
+	pc, err := d.ListenPacket(c.ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !c.wdeadline.IsZero() {
+		pc.SetWriteDeadline(c.wdeadline)
+	}
+	c.conns[d] = pc
+	go func() {
+		for {
+			b := make([]byte, PacketMaxSize)
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			select {
+			case c.packets <- routePacket{b: b[:n], addr: addr}:
+			case <-c.closed:
+				return
+			}
+		}
+	}()
+	return pc, nil
+}
+
+func (c *routePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	d, err := c.dialer.dialerOf(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	pc, err := c.conn(d)
+	if err != nil {
+		return 0, err
+	}
+	return pc.WriteTo(b, addr)
+}
+
+func (c *routePacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.lock.Lock()
+		deadline, dchange := c.deadline, c.dchange
+		c.lock.Unlock()
+		var timeout <-chan time.Time
+		var t *time.Timer
+		if !deadline.IsZero() {
+			t = time.NewTimer(time.Until(deadline))
+			timeout = t.C
+		}
+		select {
+		case p := <-c.packets:
+			stopTimer(t)
+			return copy(b, p.b), p.addr, nil
+		case <-timeout:
+			return 0, nil, &net.OpError{Op: "read", Net: "udp", Err: errTimeout{}}
+		case <-c.closed:
+			stopTimer(t)
+			return 0, nil, &net.OpError{Op: "read", Net: "udp", Err: net.ErrClosed}
+		case <-dchange:
+			// deadline changed while blocked
+			stopTimer(t)
+		}
+	}
+}
+
+// stopTimer stops t if not nil
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+func (c *routePacketConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.lock.Lock()
+		for _, pc := range c.conns {
+			pc.Close()
+		}
+		c.lock.Unlock()
+	})
+	return nil
+}
+
+func (c *routePacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{}
+}
+
+func (c *routePacketConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *routePacketConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.deadline = t
+	close(c.dchange)
+	c.dchange = make(chan struct{})
+	return nil
+}
+
+func (c *routePacketConn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// conns created later get the deadline too
+	c.wdeadline = t
+	for _, pc := range c.conns {
+		pc.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// errTimeout a net.Error for timeout
+type errTimeout struct{}
+
+func (errTimeout) Error() string   { return "i/o timeout" }
+func (errTimeout) Timeout() bool   { return true }
+func (errTimeout) Temporary() bool { return true }
@@ -0,0 +1,188 @@
+package core
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const routerServerAddr = ":12324"
+const routerEchoAddr = ":12325"
+
+const testRules = `
+# test rules
+DOMAIN,exact.com,reject
+DOMAIN-SUFFIX,.example.com,direct
+DOMAIN-KEYWORD,google,proxy:backup
+DOMAIN-REGEX,^ads[0-9]*\.,reject
+DOMAIN-REGEX, ^cdn[0-9]{1,2}\.test\.com$ ,direct
+IP-CIDR,10.0.0.0/8,direct
+IP-CIDR6,fd00::/8,direct
+PORT,6881-6889,reject
+FINAL,proxy
+`
+
+func TestParseRules(t *testing.T) {
+	router, err := ParseRules(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatalf("Cannot parse rules: %v", err)
+	}
+	cases := map[string]string{
+		"exact.com:80":         "reject",
+		"sub.exact.com:80":     "proxy",
+		"example.com:443":      "direct",
+		"WWW.Example.COM.:443": "direct",
+		"notexample.com:443":   "proxy",
+		"www.google.com:443":   "proxy:backup",
+		"ads1.test.com:80":     "reject",
+		"cdn12.test.com:80":    "direct",
+		"cdn123.test.com:80":   "proxy",
+		"10.1.2.3:80":          "direct",
+		"11.1.2.3:80":          "proxy",
+		"[fd00::1]:80":         "direct",
+		"1.2.3.4:6881":         "reject",
+		"1.2.3.4:6890":         "proxy",
+	}
+	for address, route := range cases {
+		if r := router.Match(address); r.String() != route {
+			t.Fatalf("Route of %s mismatch, expected %s, got %s", address, route, r)
+		}
+	}
+
+	bad := []string{
+		"DOMAIN,example.com",
+		"UNKNOWN,example.com,proxy",
+		"DOMAIN,example.com,unknown",
+		"IP-CIDR,10.0.0.0,direct",
+		"DOMAIN-REGEX,[,direct",
+		"PORT,90-80,direct",
+		"FINAL,unknown",
+	}
+	for _, rule := range bad {
+		if _, err = ParseRules(strings.NewReader(rule)); err != ErrBadRule {
+			t.Fatalf("Should fail to parse rule %s", rule)
+		}
+	}
+}
+
+// recordingDialer records targets dialed through ProxyDialer
+type recordingDialer struct {
+	ProxyDialer
+	targets []string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.targets = append(d.targets, address)
+	return d.ProxyDialer.DialContext(ctx, network, address)
+}
+
+func TestRouteDialer(t *testing.T) {
+	config, err := ParseConfigFromURL("flee://hello@127.0.0.1" + routerServerAddr + "#main")
+	if err != nil {
+		t.Fatalf("Cannot parse config: %v", err)
+	}
+	c, _ := config.NewCipher()
+
+	echo := startTestEchoServer(t, routerEchoAddr)
+	defer echo.Close()
+	fl, fp := startTestFleeServer(t, routerServerAddr, c)
+	defer fl.Close()
+	defer fp.Close()
+
+	router, err := ParseRules(strings.NewReader("DOMAIN,localhost,proxy:main\nIP-CIDR,127.0.0.0/8,direct\nPORT,1-1024,reject\nFINAL,proxy:missing"))
+	if err != nil {
+		t.Fatalf("Cannot parse rules: %v", err)
+	}
+	d, err := NewRouteDialer(router, config)
+	if err != nil {
+		t.Fatalf("Cannot create RouteDialer: %v", err)
+	}
+	proxy := &recordingDialer{ProxyDialer: d.Proxies["main"]}
+	direct := &recordingDialer{ProxyDialer: d.Direct}
+	d.Proxies["main"] = proxy
+	d.Direct = direct
+
+	for _, address := range []string{"localhost" + routerEchoAddr, "127.0.0.1" + routerEchoAddr} {
+		conn, err := d.DialContext(context.Background(), "tcp", address)
+		if err != nil {
+			t.Fatalf("Cannot dial %s: %v", address, err)
+		}
+		str := randomPayloadString()
+		go conn.Write([]byte(str))
+		res := make([]byte, len(str))
+		if _, err = io.ReadFull(conn, res); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if string(res) != str {
+			t.Fatal("Str mismatch")
+		}
+		conn.Close()
+	}
+	if len(proxy.targets) != 1 || proxy.targets[0] != "localhost"+routerEchoAddr {
+		t.Fatalf("Proxy targets mismatch: %v", proxy.targets)
+	}
+	if len(direct.targets) != 1 || direct.targets[0] != "127.0.0.1"+routerEchoAddr {
+		t.Fatalf("Direct targets mismatch: %v", direct.targets)
+	}
+
+	if _, err = d.DialContext(context.Background(), "tcp", "example.com:80"); err != ErrRouteRejected {
+		t.Fatal("Should be rejected")
+	}
+	if _, err = d.DialContext(context.Background(), "tcp", "example.com:8080"); err != ErrUnknownProxy {
+		t.Fatal("Should fail with unknown proxy")
+	}
+
+	// UDP, test FleeGrid server echoes packets
+	pc, err := d.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatalf("Cannot listen packet: %v", err)
+	}
+	defer pc.Close()
+	target, _ := ParseAddr("localhost:53")
+	if _, err = pc.WriteTo([]byte("hello world!"), target); err != nil {
+		t.Fatalf("Failed to write UDP: %v", err)
+	}
+	buf := make([]byte, PacketMaxSize)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "hello world!" {
+		t.Fatalf("Failed to read UDP: %v", err)
+	}
+	rejected, _ := ParseAddr("example.com:53")
+	if _, err = pc.WriteTo([]byte("hello world!"), rejected); err != ErrRouteRejected {
+		t.Fatal("Should be rejected")
+	}
+}
+
+func TestRoutePacketConnDeadline(t *testing.T) {
+	router, _ := ParseRules(strings.NewReader("FINAL,direct"))
+	d := &RouteDialer{Router: router}
+	// direct routes share a DirectDialer, so its packet conn is reused
+	d1, _ := d.dialerOf("127.0.0.1:53")
+	d2, _ := d.dialerOf("127.0.0.1:54")
+	if d1 != d2 {
+		t.Fatal("Direct dialer should be shared")
+	}
+
+	pc, _ := d.ListenPacket(context.Background())
+	defer pc.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := pc.ReadFrom(make([]byte, PacketMaxSize))
+		done <- err
+	}()
+	// deadline set after ReadFrom blocked
+	time.Sleep(20 * time.Millisecond)
+	pc.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	select {
+	case err := <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("Should time out: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadFrom should be woken up by SetReadDeadline")
+	}
+}
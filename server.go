@@ -0,0 +1,523 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTargetRejected target is rejected by ACL
+var ErrTargetRejected = errors.New("target rejected")
+
+// ServerEventType type of ServerEvent
+type ServerEventType int
+
+// types of ServerEvent
+const (
+	// client connected, or first packet of client received
+	EventAccepted ServerEventType = iota
+	// target address read and allowed, outbound connected
+	EventConnected
+	// target rejected by ACL
+	EventRejected
+	// handshake or outbound failed
+	EventError
+	// relay finished
+	EventClosed
+)
+
+var serverEventNames = []string{"accepted", "connected", "rejected", "error", "closed"}
+
+func (t ServerEventType) String() string {
+	return serverEventNames[t]
+}
+
+// ServerEvent a structured event for logging
+type ServerEvent struct {
+	Type ServerEventType
+	// "tcp" or "udp"
+	Network string
+	// remote address of client
+	Client net.Addr
+	// user identified, empty for single user server
+	User string
+	// target address
+	Target string
+	// error for EventError and EventClosed
+	Err error
+	// bytes from client to target and target to client, for EventClosed
+	BytesUp   int64
+	BytesDown int64
+	// duration since accepted, for EventClosed
+	Duration time.Duration
+}
+
+// Server a FleeGrid server, reads target address from StreamConn and PacketConn, connects out and relays
+type Server struct {
+	// Cipher for single user server
+	Cipher Cipher
+	// Users for multi-user server, takes precedence over Cipher
+	Users *MultiUserCipher
+
+	// Dial outbound dialer, default to net.Dialer
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// ListenPacket outbound packet listener, default to net.ListenPacket("udp", "")
+	ListenPacket func(ctx context.Context) (net.PacketConn, error)
+	// Allow outbound ACL, returns false to reject target, default to allow all
+	Allow func(user, network string, target Addr) bool
+	// OnEvent receives structured events
+	OnEvent func(e *ServerEvent)
+
+	// HandshakeTimeout timeout for reading target address
+	HandshakeTimeout time.Duration
+	// DialTimeout timeout for connecting target
+	DialTimeout time.Duration
+	// UDPTimeout idle timeout of UDP associations
+	UDPTimeout time.Duration
+	// IdleTimeout closes TCP connections without traffic for timeout, 0 disables
+	IdleTimeout time.Duration
+	// KeepAlive TCP keepalive period of client connections, 0 keeps system default
+	KeepAlive time.Duration
+
+	// Stats optional traffic accounting and quota
+	Stats *Stats
+
+	// MuxConfig options of mux sessions requested by clients, see MuxDialer
+	MuxConfig *MuxConfig
+
+	// PacketSession accepts UDP packets sent in sessions, see PacketConn.AcceptPacketSession
+	PacketSession bool
+}
+
+// default timeouts of Server
+const (
+	DefaultHandshakeTimeout = 30 * time.Second
+	DefaultDialTimeout      = 10 * time.Second
+	DefaultUDPTimeout       = 2 * time.Minute
+)
+
+// NewServer create a new Server from one or more Config, multiple Config creates a multi-user server,
+// so does a Config accepting multiple ciphers, see Config.ServerCiphers
+// Config.Name is used as user name, index is used if empty
+func NewServer(configs ...*Config) (*Server, error) {
+	s := &Server{}
+	for _, config := range configs {
+		s.PacketSession = s.PacketSession || config.PacketSession
+	}
+	if len(configs) == 1 && configs[0].Cipher != CipherAuto && len(configs[0].AcceptCiphers) == 0 {
+		c, err := configs[0].NewCipher()
+		if err != nil {
+			return nil, err
+		}
+		s.Cipher = c
+		return s, nil
+	}
+	s.Users = NewMultiUserCipher()
+	for i, config := range configs {
+		cs, err := config.ServerCiphers()
+		if err != nil {
+			return nil, err
+		}
+		name := config.Name
+		if len(name) == 0 {
+			name = strconv.Itoa(i)
+		}
+		s.Users.AddCiphers(name, cs...)
+	}
+	return s, nil
+}
+
+// Destroy destroys ciphers of Server, see DestroyCipher
+// should be called when a Server is replaced, like on config reload, after its listeners are closed
+// connections still served fail with ErrCipherDestroyed once they need a new subkey, like on rekey
+func (s *Server) Destroy() {
+	DestroyCipher(s.Cipher)
+	if s.Users != nil {
+		s.Users.Destroy()
+	}
+}
+
+func (s *Server) emit(e *ServerEvent) {
+	if s.OnEvent != nil {
+		s.OnEvent(e)
+	}
+}
+
+func (s *Server) allow(user, network string, target Addr) bool {
+	return s.Allow == nil || s.Allow(user, network, target)
+}
+
+func (s *Server) dialTimeout() time.Duration {
+	if s.DialTimeout == 0 {
+		return DefaultDialTimeout
+	}
+	return s.DialTimeout
+}
+
+func (s *Server) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.dialTimeout())
+	defer cancel()
+	if s.Dial != nil {
+		return s.Dial(ctx, network, address)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+func (s *Server) listenPacket(ctx context.Context) (net.PacketConn, error) {
+	if s.ListenPacket != nil {
+		return s.ListenPacket(ctx)
+	}
+	var lc net.ListenConfig
+	return lc.ListenPacket(ctx, "udp", "")
+}
+
+// ListenAndServe listens on address for both TCP and UDP, and serves
+func (s *Server) ListenAndServe(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	go s.ServePacket(pc)
+	err = s.Serve(l)
+	pc.Close()
+	return err
+}
+
+// Serve accepts connections from net.Listener and serves each in a goroutine
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a TCP connection, closes it when finished
+func (s *Server) ServeConn(conn net.Conn) {
+	start := time.Now()
+	var sconn *StreamConn
+	if s.Users != nil {
+		sconn = NewMultiUserStreamConn(conn, s.Users)
+	} else {
+		sconn = NewServerStreamConn(conn, s.Cipher)
+	}
+	defer sconn.Close()
+	if s.Stats != nil {
+		sconn.SetStats(s.Stats)
+	}
+	if s.KeepAlive > 0 {
+		sconn.SetKeepAlive(s.KeepAlive)
+	}
+	sconn.SetIdleTimeout(s.IdleTimeout)
+	e := ServerEvent{Type: EventAccepted, Network: "tcp", Client: conn.RemoteAddr()}
+	accepted := e
+	s.emit(&accepted)
+
+	// read target address
+	timeout := s.HandshakeTimeout
+	if timeout == 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	sconn.SetDeadline(time.Now().Add(timeout))
+	// salt is sent once client is identified, so Handshake of client completes before it sends data
+	err := sconn.Handshake(context.Background())
+	var target Addr
+	if err == nil {
+		target, err = ReadAddr(sconn)
+	}
+	e.User = sconn.User()
+	if err != nil {
+		s.emit(&ServerEvent{Type: EventError, Network: "tcp", Client: e.Client, User: e.User, Err: err})
+		return
+	}
+	sconn.SetDeadline(time.Time{})
+
+	if target.String() == MuxAddress {
+		s.serveMux(sconn, e, timeout)
+		return
+	}
+	s.serveTarget(sconn, e, target, start)
+}
+
+// serveMux serves streams of a mux session, each stream starts with its target address
+func (s *Server) serveMux(sconn *StreamConn, e ServerEvent, timeout time.Duration) {
+	session := NewMuxSession(sconn, false, s.MuxConfig)
+	defer session.Close()
+	for {
+		st, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer st.Close()
+			start := time.Now()
+			st.SetReadDeadline(start.Add(timeout))
+			target, err := ReadAddr(st)
+			if err != nil {
+				s.emit(&ServerEvent{Type: EventError, Network: "tcp", Client: e.Client, User: e.User, Err: err})
+				return
+			}
+			st.SetReadDeadline(time.Time{})
+			s.serveTarget(st, e, target, start)
+		}()
+	}
+}
+
+// serveTarget connects target and relays conn with it
+func (s *Server) serveTarget(conn net.Conn, e ServerEvent, target Addr, start time.Time) {
+	e.Target = target.String()
+
+	if !s.allow(e.User, "tcp", target) {
+		s.emit(&ServerEvent{Type: EventRejected, Network: "tcp", Client: e.Client, User: e.User, Target: e.Target, Err: ErrTargetRejected})
+		return
+	}
+
+	rconn, err := s.dial(context.Background(), "tcp", e.Target)
+	if err != nil {
+		s.emit(&ServerEvent{Type: EventError, Network: "tcp", Client: e.Client, User: e.User, Target: e.Target, Err: err})
+		return
+	}
+	defer rconn.Close()
+	s.emit(&ServerEvent{Type: EventConnected, Network: "tcp", Client: e.Client, User: e.User, Target: e.Target})
+
+	down, up, err := Relay(conn, rconn)
+	s.emit(&ServerEvent{
+		Type:      EventClosed,
+		Network:   "tcp",
+		Client:    e.Client,
+		User:      e.User,
+		Target:    e.Target,
+		Err:       err,
+		BytesUp:   up,
+		BytesDown: down,
+		Duration:  time.Since(start),
+	})
+}
+
+// packetSession outbound packet connection of a client
+type packetSession struct {
+	up   int64
+	down int64
+	net.PacketConn
+	user   string
+	start  time.Time
+	client net.Addr
+	// resolved domain names of targets
+	rlock    sync.Mutex
+	resolved map[string]*resolveResult
+}
+
+// resolveResult result of resolving a domain name, done is closed when resolved
+type resolveResult struct {
+	done chan struct{}
+	addr *net.UDPAddr
+	err  error
+}
+
+// cachedAddr returns UDP address of target without blocking, if target is IP or resolved already
+func (ss *packetSession) cachedAddr(target Addr) (*net.UDPAddr, bool) {
+	switch target[0] {
+	case AddrTypeIPv4:
+		return &net.UDPAddr{IP: net.IP(target[1 : 1+net.IPv4len]), Port: target.Port()}, true
+	case AddrTypeIPv6:
+		return &net.UDPAddr{IP: net.IP(target[1 : 1+net.IPv6len]), Port: target.Port()}, true
+	}
+	ss.rlock.Lock()
+	defer ss.rlock.Unlock()
+	r := ss.resolved[target.String()]
+	if r == nil {
+		return nil, false
+	}
+	select {
+	case <-r.done:
+		return r.addr, r.err == nil
+	default:
+		return nil, false
+	}
+}
+
+// resolve resolves target, concurrent lookups of the same name are shared, failures are not cached
+func (ss *packetSession) resolve(ctx context.Context, target string) (*net.UDPAddr, error) {
+	ss.rlock.Lock()
+	r := ss.resolved[target]
+	if r == nil {
+		r = &resolveResult{done: make(chan struct{})}
+		if ss.resolved == nil {
+			ss.resolved = map[string]*resolveResult{}
+		}
+		ss.resolved[target] = r
+		ss.rlock.Unlock()
+		r.addr, r.err = resolveUDPAddr(ctx, target)
+		close(r.done)
+		if r.err != nil {
+			ss.rlock.Lock()
+			delete(ss.resolved, target)
+			ss.rlock.Unlock()
+		}
+		return r.addr, r.err
+	}
+	ss.rlock.Unlock()
+	select {
+	case <-r.done:
+		return r.addr, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolveUDPAddr resolves host:port with context
+func resolveUDPAddr(ctx context.Context, address string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	p, err := net.DefaultResolver.LookupPort(ctx, "udp", port)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ips[0].IP, Port: p, Zone: ips[0].Zone}, nil
+}
+
+// ServePacket serves a net.PacketConn, returns when it is closed
+func (s *Server) ServePacket(pc net.PacketConn) error {
+	var conn *PacketConn
+	if s.Users != nil {
+		conn, _ = NewMultiUserPacketConn(pc, s.Users)
+	} else {
+		conn, _ = NewPacketConn(pc, s.Cipher)
+	}
+	if s.Stats != nil {
+		conn.SetStats(s.Stats)
+	}
+	conn.AcceptPacketSession(s.PacketSession)
+	timeout := s.UDPTimeout
+	if timeout == 0 {
+		timeout = DefaultUDPTimeout
+	}
+
+	var lock sync.Mutex
+	sessions := map[string]*packetSession{}
+	defer func() {
+		lock.Lock()
+		for _, ss := range sessions {
+			ss.Close()
+		}
+		lock.Unlock()
+	}()
+
+	buf := make([]byte, PacketMaxSize)
+	for {
+		n, client, user, err := conn.ReadFromUser(buf)
+		if err != nil {
+			// error of underlying net.PacketConn
+			if _, ok := err.(net.Error); ok {
+				return err
+			}
+			// bad packet
+			continue
+		}
+		target, err := SplitAddr(buf[:n])
+		if err != nil {
+			s.emit(&ServerEvent{Type: EventError, Network: "udp", Client: client, User: user, Err: err})
+			continue
+		}
+		if !s.allow(user, "udp", target) {
+			s.emit(&ServerEvent{Type: EventRejected, Network: "udp", Client: client, User: user, Target: target.String(), Err: ErrTargetRejected})
+			continue
+		}
+
+		lock.Lock()
+		ss := sessions[client.String()]
+		if ss == nil {
+			rc, err := s.listenPacket(context.Background())
+			if err != nil {
+				lock.Unlock()
+				s.emit(&ServerEvent{Type: EventError, Network: "udp", Client: client, User: user, Target: target.String(), Err: err})
+				continue
+			}
+			ss = &packetSession{PacketConn: rc, user: user, start: time.Now(), client: client}
+			sessions[client.String()] = ss
+			s.emit(&ServerEvent{Type: EventAccepted, Network: "udp", Client: client, User: user, Target: target.String()})
+			go func() {
+				err := s.relayPacket(conn, ss, timeout)
+				lock.Lock()
+				delete(sessions, ss.client.String())
+				lock.Unlock()
+				ss.Close()
+				s.emit(&ServerEvent{
+					Type:      EventClosed,
+					Network:   "udp",
+					Client:    ss.client,
+					User:      ss.user,
+					Err:       err,
+					BytesUp:   atomic.LoadInt64(&ss.up),
+					BytesDown: atomic.LoadInt64(&ss.down),
+					Duration:  time.Since(ss.start),
+				})
+			}()
+		}
+		lock.Unlock()
+		atomic.AddInt64(&ss.up, int64(n-len(target)))
+
+		ss.SetReadDeadline(time.Now().Add(timeout))
+		if taddr, ok := ss.cachedAddr(target); ok {
+			ss.WriteTo(buf[len(target):n], taddr)
+			continue
+		}
+		// domain names are resolved off the read loop, so a slow DNS does not stall other clients
+		target = append(Addr(nil), target...)
+		payload := append([]byte(nil), buf[len(target):n]...)
+		go func(ss *packetSession, client net.Addr, user string) {
+			ctx, cancel := context.WithTimeout(context.Background(), s.dialTimeout())
+			defer cancel()
+			taddr, err := ss.resolve(ctx, target.String())
+			if err != nil {
+				s.emit(&ServerEvent{Type: EventError, Network: "udp", Client: client, User: user, Target: target.String(), Err: err})
+				return
+			}
+			ss.WriteTo(payload, taddr)
+		}(ss, client, user)
+	}
+}
+
+// relayPacket relays packets from targets back to client until idle timeout
+func (s *Server) relayPacket(conn *PacketConn, ss *packetSession, timeout time.Duration) error {
+	buf := make([]byte, PacketMaxSize)
+	for {
+		ss.SetReadDeadline(time.Now().Add(timeout))
+		n, addr, err := ss.ReadFrom(buf[AddrMaxSize:])
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil
+			}
+			return err
+		}
+		src, err := ParseAddr(addr.String())
+		if err != nil {
+			continue
+		}
+		// place source address right before data
+		start := AddrMaxSize - len(src)
+		copy(buf[start:], src)
+		if _, err = conn.WriteTo(buf[start:AddrMaxSize+n], ss.client); err != nil {
+			return err
+		}
+		atomic.AddInt64(&ss.down, int64(n))
+	}
+}
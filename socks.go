@@ -0,0 +1,287 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+// SOCKS5 constants
+const (
+	socksVersion     = 5
+	socksAuthVersion = 1
+
+	socksMethodNoAuth       = 0
+	socksMethodPasswd       = 2
+	socksMethodNoAcceptable = 0xff
+
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
+
+	socksRepSucceeded           = 0
+	socksRepGeneralFailure      = 1
+	socksRepHostUnreachable     = 4
+	socksRepCommandNotSupported = 7
+)
+
+var (
+	// ErrSOCKSVersion SOCKS version is not 5
+	ErrSOCKSVersion = errors.New("socks version is not supported")
+	// ErrSOCKSAuth SOCKS authentication failed
+	ErrSOCKSAuth = errors.New("socks authentication failed")
+	// ErrSOCKSCommand SOCKS command is not supported
+	ErrSOCKSCommand = errors.New("socks command is not supported")
+)
+
+// SOCKSServer a SOCKS5 server with CONNECT and UDP ASSOCIATE, tunneling through ProxyDialer
+type SOCKSServer struct {
+	// dialer for targets, usually a *Dialer
+	Dialer ProxyDialer
+	// optional username and password
+	Username string
+	Passwd   string
+}
+
+// NewSOCKSServer create a new SOCKSServer tunneling through FleeGrid server of Config
+func NewSOCKSServer(config *Config) (*SOCKSServer, error) {
+	d, err := NewDialer(config)
+	if err != nil {
+		return nil, err
+	}
+	return &SOCKSServer{Dialer: d}, nil
+}
+
+// ListenAndServe listens on a TCP address and serves
+func (s *SOCKSServer) ListenAndServe(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections from net.Listener and serves each in a goroutine
+func (s *SOCKSServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a SOCKS5 connection, closes it when finished
+func (s *SOCKSServer) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+
+	if err := s.negotiate(conn); err != nil {
+		return err
+	}
+
+	// VER CMD RSV
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != socksVersion {
+		return ErrSOCKSVersion
+	}
+	target, err := ReadAddr(conn)
+	if err != nil {
+		return err
+	}
+
+	switch buf[1] {
+	case socksCmdConnect:
+		return s.connect(conn, target)
+	case socksCmdUDPAssociate:
+		return s.associate(conn)
+	}
+	s.reply(conn, socksRepCommandNotSupported, nil)
+	return ErrSOCKSCommand
+}
+
+// negotiate negotiates authentication method
+func (s *SOCKSServer) negotiate(conn net.Conn) error {
+	// VER NMETHODS
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != socksVersion {
+		return ErrSOCKSVersion
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+
+	method := byte(socksMethodNoAuth)
+	if len(s.Username) > 0 || len(s.Passwd) > 0 {
+		method = socksMethodPasswd
+	}
+	found := false
+	for _, m := range methods {
+		if m == method {
+			found = true
+		}
+	}
+	if !found {
+		conn.Write([]byte{socksVersion, socksMethodNoAcceptable})
+		return ErrSOCKSAuth
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return err
+	}
+	if method == socksMethodPasswd {
+		return s.authenticate(conn)
+	}
+	return nil
+}
+
+// authenticate username/password authentication, RFC 1929
+func (s *SOCKSServer) authenticate(conn net.Conn) error {
+	// VER ULEN UNAME PLEN PASSWD
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != socksAuthVersion {
+		return ErrSOCKSVersion
+	}
+	uname := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, uname); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return err
+	}
+	passwd := make([]byte, buf[0])
+	if _, err := io.ReadFull(conn, passwd); err != nil {
+		return err
+	}
+	if string(uname) != s.Username || string(passwd) != s.Passwd {
+		conn.Write([]byte{socksAuthVersion, 1})
+		return ErrSOCKSAuth
+	}
+	_, err := conn.Write([]byte{socksAuthVersion, 0})
+	return err
+}
+
+// reply writes a reply with bound address, nil for 0.0.0.0:0
+func (s *SOCKSServer) reply(conn net.Conn, rep byte, bound Addr) error {
+	if bound == nil {
+		bound = Addr{AddrTypeIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	_, err := conn.Write(append([]byte{socksVersion, rep, 0}, bound...))
+	return err
+}
+
+// connect handles CONNECT command
+func (s *SOCKSServer) connect(conn net.Conn, target Addr) error {
+	rconn, err := s.Dialer.DialContext(context.Background(), "tcp", target.String())
+	if err != nil {
+		s.reply(conn, socksRepHostUnreachable, nil)
+		return err
+	}
+	defer rconn.Close()
+	if err = s.reply(conn, socksRepSucceeded, nil); err != nil {
+		return err
+	}
+	_, _, err = Relay(conn, rconn)
+	return err
+}
+
+// associate handles UDP ASSOCIATE command, association ends when conn is closed
+func (s *SOCKSServer) associate(conn net.Conn) error {
+	// listen on same IP as the TCP connection
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	lconn, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		s.reply(conn, socksRepGeneralFailure, nil)
+		return err
+	}
+	defer lconn.Close()
+	rconn, err := s.Dialer.ListenPacket(context.Background())
+	if err != nil {
+		s.reply(conn, socksRepGeneralFailure, nil)
+		return err
+	}
+	defer rconn.Close()
+
+	bound, err := ParseAddr(lconn.LocalAddr().String())
+	if err != nil {
+		s.reply(conn, socksRepGeneralFailure, nil)
+		return err
+	}
+	if err = s.reply(conn, socksRepSucceeded, bound); err != nil {
+		return err
+	}
+
+	var client net.Addr
+	var lock sync.Mutex
+	clientHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	// client -> targets
+	go func() {
+		buf := make([]byte, PacketMaxSize)
+		for {
+			n, addr, err := lconn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// only accept packets from the client host
+			if h, _, _ := net.SplitHostPort(addr.String()); h != clientHost {
+				continue
+			}
+			// RSV RSV FRAG ATYP DST.ADDR DST.PORT DATA, fragments are not supported
+			if n < 3 || buf[2] != 0 {
+				continue
+			}
+			target, err := SplitAddr(buf[3:n])
+			if err != nil {
+				continue
+			}
+			lock.Lock()
+			client = addr
+			lock.Unlock()
+			rconn.WriteTo(buf[3+len(target):n], target)
+		}
+	}()
+
+	// targets -> client
+	go func() {
+		buf := make([]byte, PacketMaxSize)
+		for {
+			n, addr, err := rconn.ReadFrom(buf[3+AddrMaxSize:])
+			if err != nil {
+				return
+			}
+			src, ok := addr.(Addr)
+			if !ok {
+				if src, err = ParseAddr(addr.String()); err != nil {
+					continue
+				}
+			}
+			lock.Lock()
+			c := client
+			lock.Unlock()
+			if c == nil {
+				continue
+			}
+			// place header right before data
+			start := 3 + AddrMaxSize - len(src) - 3
+			copy(buf[start:], []byte{0, 0, 0})
+			copy(buf[start+3:], src)
+			lconn.WriteTo(buf[start:3+AddrMaxSize+n], c)
+		}
+	}()
+
+	// association ends when TCP connection closes
+	io.Copy(ioutil.Discard, conn)
+	return nil
+}
@@ -0,0 +1,277 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrQuotaExceeded user exceeded byte quota
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// StatsSnapshot a point-in-time copy of traffic counters
+// bytes are payload bytes, excluding salt, length chunks and AEAD overhead
+type StatsSnapshot struct {
+	BytesIn       uint64
+	BytesOut      uint64
+	RecordsIn     uint64
+	RecordsOut    uint64
+	AuthFailures  uint64
+	Handshakes    uint64
+	HandshakeTime time.Duration
+}
+
+// Bytes total bytes in both directions
+func (s StatsSnapshot) Bytes() uint64 {
+	return s.BytesIn + s.BytesOut
+}
+
+// Counters traffic counters, safe for concurrent use
+type Counters struct {
+	bytesIn       uint64
+	bytesOut      uint64
+	recordsIn     uint64
+	recordsOut    uint64
+	authFailures  uint64
+	handshakes    uint64
+	handshakeTime uint64
+}
+
+func (c *Counters) addIn(n int) {
+	atomic.AddUint64(&c.bytesIn, uint64(n))
+	atomic.AddUint64(&c.recordsIn, 1)
+}
+
+func (c *Counters) addOut(n int) {
+	atomic.AddUint64(&c.bytesOut, uint64(n))
+	atomic.AddUint64(&c.recordsOut, 1)
+}
+
+func (c *Counters) addAuthFailure() {
+	atomic.AddUint64(&c.authFailures, 1)
+}
+
+func (c *Counters) addHandshake(d time.Duration) {
+	atomic.AddUint64(&c.handshakes, 1)
+	atomic.AddUint64(&c.handshakeTime, uint64(d))
+}
+
+func (c *Counters) bytes() uint64 {
+	return atomic.LoadUint64(&c.bytesIn) + atomic.LoadUint64(&c.bytesOut)
+}
+
+// Snapshot returns current values of counters
+func (c *Counters) Snapshot() StatsSnapshot {
+	return StatsSnapshot{
+		BytesIn:       atomic.LoadUint64(&c.bytesIn),
+		BytesOut:      atomic.LoadUint64(&c.bytesOut),
+		RecordsIn:     atomic.LoadUint64(&c.recordsIn),
+		RecordsOut:    atomic.LoadUint64(&c.recordsOut),
+		AuthFailures:  atomic.LoadUint64(&c.authFailures),
+		Handshakes:    atomic.LoadUint64(&c.handshakes),
+		HandshakeTime: time.Duration(atomic.LoadUint64(&c.handshakeTime)),
+	}
+}
+
+// drain returns current values of counters and resets them
+func (c *Counters) drain() StatsSnapshot {
+	return StatsSnapshot{
+		BytesIn:       atomic.SwapUint64(&c.bytesIn, 0),
+		BytesOut:      atomic.SwapUint64(&c.bytesOut, 0),
+		RecordsIn:     atomic.SwapUint64(&c.recordsIn, 0),
+		RecordsOut:    atomic.SwapUint64(&c.recordsOut, 0),
+		AuthFailures:  atomic.SwapUint64(&c.authFailures, 0),
+		Handshakes:    atomic.SwapUint64(&c.handshakes, 0),
+		HandshakeTime: time.Duration(atomic.SwapUint64(&c.handshakeTime, 0)),
+	}
+}
+
+// QuotaFunc checks usage of a user, non-nil error cuts off connections of the user
+type QuotaFunc func(user string, usage StatsSnapshot) error
+
+// StatsReport aggregated counters of all connections and per user
+type StatsReport struct {
+	Total StatsSnapshot
+	Users map[string]StatsSnapshot
+}
+
+// Stats aggregates counters of many StreamConn and PacketConn by user
+// connections without identified user are counted as user ""
+type Stats struct {
+	// Quota custom quota check, called after each record
+	Quota QuotaFunc
+
+	total  Counters
+	lock   sync.RWMutex
+	users  map[string]*Counters
+	quotas map[string]uint64
+}
+
+// NewStats create a new Stats
+func NewStats() *Stats {
+	return &Stats{
+		users:  map[string]*Counters{},
+		quotas: map[string]uint64{},
+	}
+}
+
+// user returns counters of a user, creates if not existed
+func (s *Stats) user(name string) *Counters {
+	s.lock.RLock()
+	c := s.users[name]
+	s.lock.RUnlock()
+	if c != nil {
+		return c
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if c = s.users[name]; c == nil {
+		c = &Counters{}
+		s.users[name] = c
+	}
+	return c
+}
+
+// SetQuota set byte quota (payload bytes in both directions) of a user, 0 for unlimited
+func (s *Stats) SetQuota(user string, bytes uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if bytes == 0 {
+		delete(s.quotas, user)
+	} else {
+		s.quotas[user] = bytes
+	}
+}
+
+// checkQuota checks byte quota and custom quota of a user
+func (s *Stats) checkQuota(user string, c *Counters) error {
+	s.lock.RLock()
+	q, ok := s.quotas[user]
+	s.lock.RUnlock()
+	if ok && c.bytes() > q {
+		return ErrQuotaExceeded
+	}
+	if s.Quota != nil {
+		return s.Quota(user, c.Snapshot())
+	}
+	return nil
+}
+
+// User returns snapshot of a user
+func (s *Stats) User(name string) StatsSnapshot {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if c := s.users[name]; c != nil {
+		return c.Snapshot()
+	}
+	return StatsSnapshot{}
+}
+
+// Snapshot returns snapshot of all counters
+func (s *Stats) Snapshot() StatsReport {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	r := StatsReport{Total: s.total.Snapshot(), Users: map[string]StatsSnapshot{}}
+	for name, c := range s.users {
+		r.Users[name] = c.Snapshot()
+	}
+	return r
+}
+
+// Drain returns snapshot of all counters and resets them, for periodical billing
+// quota usage is reset as well
+func (s *Stats) Drain() StatsReport {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	r := StatsReport{Total: s.total.drain(), Users: map[string]StatsSnapshot{}}
+	for name, c := range s.users {
+		r.Users[name] = c.drain()
+	}
+	return r
+}
+
+// meter counts traffic of a connection, nil meter counts nothing
+type meter struct {
+	Counters
+	stats  *Stats
+	closer io.Closer
+}
+
+// counters returns aggregated counters of a user, nil if no Stats
+func (m *meter) counters(user string) *Counters {
+	if m.stats == nil {
+		return nil
+	}
+	return m.stats.user(user)
+}
+
+// in counts an incoming record of user
+func (m *meter) in(user string, n int) error {
+	if m == nil {
+		return nil
+	}
+	m.addIn(n)
+	if c := m.counters(user); c != nil {
+		c.addIn(n)
+		m.stats.total.addIn(n)
+		return m.check(user, c)
+	}
+	return nil
+}
+
+// out counts an outgoing record of user
+func (m *meter) out(user string, n int) error {
+	if m == nil {
+		return nil
+	}
+	m.addOut(n)
+	if c := m.counters(user); c != nil {
+		c.addOut(n)
+		m.stats.total.addOut(n)
+		return m.check(user, c)
+	}
+	return nil
+}
+
+// authFailure counts a failed decryption
+func (m *meter) authFailure(user string) {
+	if m == nil {
+		return
+	}
+	m.addAuthFailure()
+	if c := m.counters(user); c != nil {
+		c.addAuthFailure()
+		m.stats.total.addAuthFailure()
+	}
+}
+
+// handshake counts a finished handshake
+func (m *meter) handshake(user string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.addHandshake(d)
+	if c := m.counters(user); c != nil {
+		c.addHandshake(d)
+		m.stats.total.addHandshake(d)
+	}
+}
+
+// allow checks quota of user without counting
+func (m *meter) allow(user string) error {
+	if m == nil || m.stats == nil {
+		return nil
+	}
+	return m.stats.checkQuota(user, m.stats.user(user))
+}
+
+// check checks quota, closes connection if exceeded
+func (m *meter) check(user string, c *Counters) error {
+	err := m.stats.checkQuota(user, c)
+	if err != nil && m.closer != nil {
+		m.closer.Close()
+	}
+	return err
+}
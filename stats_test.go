@@ -0,0 +1,128 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+const statsStreamAddr = ":12306"
+const statsPacketAddr = ":12307"
+
+func TestStreamConnStats(t *testing.T) {
+	m, ciphers := createTestUsers(t)
+	stats := NewStats()
+	stats.SetQuota("bob", PayloadMaxSize*4)
+
+	l, err := net.Listen("tcp", statsStreamAddr)
+	if err != nil {
+		t.Fatalf("Cannot listen socket")
+	}
+	defer l.Close()
+
+	type result struct {
+		n    int
+		snap StatsSnapshot
+		err  error
+	}
+	results := make(chan result, 1)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				break
+			}
+			go func() {
+				sconn := NewMultiUserStreamConn(conn, m)
+				sconn.SetStats(stats)
+				res, err := ioutil.ReadAll(sconn)
+				results <- result{n: len(res), snap: sconn.Stats(), err: err}
+				sconn.Close()
+			}()
+		}
+	}()
+
+	send := func(user string, size int) result {
+		conn, err := net.Dial("tcp", "127.0.0.1"+statsStreamAddr)
+		if err != nil {
+			t.Fatal("Cannot dial socket")
+		}
+		cconn := NewStreamConn(conn, ciphers[user])
+		go func() {
+			cconn.ReadFrom(bytes.NewReader(make([]byte, size)))
+			cconn.Close()
+		}()
+		return <-results
+	}
+
+	res := send("alice", PayloadMaxSize*2+1)
+	if res.err != nil || res.n != PayloadMaxSize*2+1 {
+		t.Fatalf("Failed to read: %v", res.err)
+	}
+	if res.snap.BytesIn != PayloadMaxSize*2+1 || res.snap.RecordsIn != 3 || res.snap.Handshakes != 1 {
+		t.Fatalf("Bad connection stats: %+v", res.snap)
+	}
+	send("alice", 100)
+	if s := stats.User("alice"); s.BytesIn != PayloadMaxSize*2+101 || s.RecordsIn != 4 || s.Handshakes != 2 {
+		t.Fatalf("Bad user stats: %+v", s)
+	}
+
+	// quota exceeded
+	res = send("bob", PayloadMaxSize*8)
+	if res.err != ErrQuotaExceeded {
+		t.Fatalf("Should exceed quota, got %v", res.err)
+	}
+
+	report := stats.Drain()
+	if report.Total.BytesIn != report.Users["alice"].BytesIn+report.Users["bob"].BytesIn {
+		t.Fatalf("Bad total stats: %+v", report)
+	}
+	if s := stats.User("alice"); s.BytesIn != 0 {
+		t.Fatalf("Stats should be reset after Drain: %+v", s)
+	}
+}
+
+func TestPacketConnStats(t *testing.T) {
+	c, _ := NewCipher("AEAD_AES_128_GCM", "hello")
+	stats := NewStats()
+
+	sn, err := net.ListenPacket("udp", "127.0.0.1"+statsPacketAddr)
+	if err != nil {
+		t.Fatal("Cannot listen socket")
+	}
+	sconn, _ := NewPacketConn(sn, c)
+	sconn.SetStats(stats)
+	defer sconn.Close()
+
+	cn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen socket")
+	}
+	cconn, _ := NewPacketConn(cn, c)
+	defer cconn.Close()
+
+	buf := make([]byte, PacketMaxSize)
+	for i := 0; i < 3; i++ {
+		cconn.WriteTo([]byte("hello world!"), sn.LocalAddr())
+		if _, _, err = sconn.ReadFrom(buf); err != nil {
+			t.Fatalf("Can't read PacketConn:%v\n", err)
+		}
+	}
+	if s := sconn.Stats(); s.BytesIn != 36 || s.RecordsIn != 3 {
+		t.Fatalf("Bad connection stats: %+v", s)
+	}
+	if s := cconn.Stats(); s.BytesOut != 36 || s.RecordsOut != 3 {
+		t.Fatalf("Bad connection stats: %+v", s)
+	}
+
+	// bad packet
+	cn.WriteTo(make([]byte, 64), sn.LocalAddr())
+	if _, _, err = sconn.ReadFrom(buf); err == nil {
+		t.Fatal("Should fail to decrypt")
+	}
+	if s := stats.User(""); s.AuthFailures != 1 || s.BytesIn != 36 {
+		t.Fatalf("Bad user stats: %+v", s)
+	}
+}
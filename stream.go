@@ -2,30 +2,69 @@ package core
 
 import (
 	"bytes"
+	"context"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // PayloadMaxSize is the maximum size of payload in bytes.
 const PayloadMaxSize = 0x3FFF // 16*1024 - 1
 
+// rekeyFlag marks a record carrying new salt in the reserved bits of payload length
+// after a rekey record, both sides switch to the subkey derived from new salt, with nonce reset to zero
+const rekeyFlag = 0x8000
+
+var (
+	// ErrNonceExhausted nonce of subkey would wrap around, the stream must be rekeyed or closed
+	ErrNonceExhausted = errors.New("nonce exhausted")
+	// ErrRekeyNotSupported received a rekey record without Cipher to derive new subkey
+	ErrRekeyNotSupported = errors.New("rekey is not supported")
+)
+
 // StreamWriter encrypt data and write to underlying io.Writer
 type StreamWriter struct {
 	io.Writer
 	cipher.AEAD
 	buf   []byte
 	nonce []byte
+	// traffic accounting
+	meter *meter
+	user  string
+	// rate limiting
+	limiters []*Limiter
+	// cipher name for metrics
+	cipher string
+	// serializes records of Write and WriteKeepAlive
+	lock sync.Mutex
+	// unix nano of last record written
+	lastWrite int64
+	// unix nano of last non-empty record, shared with StreamReader
+	activity *int64
+	// remainder of a record interrupted by error like timeout, written before next record
+	pending []byte
+	// rekey with new salt after records written with a subkey, 0 disables
+	rekeyAfter uint64
+	records    uint64
+	// derives subkey of new salt
+	keys Cipher
+	// overhead of AEAD, fixed across rekeys, so records can be sized without lock
+	overhead int
 }
 
 // NewStreamWriter create a StreamWriter
 func NewStreamWriter(w io.Writer, a cipher.AEAD) *StreamWriter {
 	return &StreamWriter{
-		Writer: w,
-		AEAD:   a,
-		buf:    make([]byte, 2+a.Overhead()+PayloadMaxSize+a.Overhead()),
-		nonce:  make([]byte, a.NonceSize()),
+		Writer:   w,
+		AEAD:     a,
+		buf:      make([]byte, 2+a.Overhead()+PayloadMaxSize+a.Overhead()),
+		nonce:    make([]byte, a.NonceSize()),
+		overhead: a.Overhead(),
 	}
 }
 
@@ -36,11 +75,17 @@ func (w *StreamWriter) Write(b []byte) (int, error) {
 }
 
 // ReadFrom encrypt and write bytes from a io.Reader
+// bytes counted as written are committed, if a record is interrupted by error like timeout, its remainder is
+// written before next record, so writing can be retried with the rest bytes
 func (w *StreamWriter) ReadFrom(r io.Reader) (n int64, err error) {
 	for {
+		// pending record shares buf, flush it first
+		if err = w.Flush(); err != nil {
+			return
+		}
 		// initial buf and puf (payload buf)
 		buf := w.buf
-		puf := buf[2+w.Overhead():]
+		puf := buf[2+w.overhead:]
 		// read to puf
 		nr, er := r.Read(puf[:PayloadMaxSize])
 
@@ -48,9 +93,19 @@ func (w *StreamWriter) ReadFrom(r io.Reader) (n int64, err error) {
 			// add total size
 			n += int64(nr)
 			// limit buf to proper size
-			buf = buf[:2+w.Overhead()+nr+w.Overhead()]
+			buf = buf[:2+w.overhead+nr+w.overhead]
 			// limit puf to proper size
-			puf = buf[2+w.Overhead():]
+			puf = buf[2+w.overhead:]
+			// wait for rate limiters
+			waitAll(w.limiters, len(buf))
+			w.lock.Lock()
+			if ew := w.prepare(); ew != nil {
+				// record is not written, so bytes are not counted
+				w.lock.Unlock()
+				n -= int64(nr)
+				err = ew
+				break
+			}
 			// set payload length
 			buf[0], buf[1] = byte(nr>>8), byte(nr) // Big-endian payload size
 			// encrypt the payload length
@@ -59,12 +114,24 @@ func (w *StreamWriter) ReadFrom(r io.Reader) (n int64, err error) {
 			// encrypt the payload
 			w.Seal(puf[:0], w.nonce, puf[:nr], nil)
 			increaseNonce(w.nonce)
+			w.records++
 			// send
-			_, ew := w.Writer.Write(buf)
+			nw, ew := w.Writer.Write(buf)
+			if ew != nil {
+				w.pending = buf[nw:]
+			}
+			w.touch(true)
+			w.lock.Unlock()
 			if ew != nil {
 				err = ew
 				break
 			}
+			// count and check quota
+			currentMetrics().recordOut(w.cipher, nr)
+			if ew = w.meter.out(w.user, nr); ew != nil {
+				err = ew
+				break
+			}
 		}
 
 		if er != nil {
@@ -78,6 +145,112 @@ func (w *StreamWriter) ReadFrom(r io.Reader) (n int64, err error) {
 	return
 }
 
+// WriteKeepAlive writes an empty record, which is discarded by StreamReader
+// peers not supporting empty records may fail to decode the stream
+func (w *StreamWriter) WriteKeepAlive() error {
+	buf := make([]byte, 2+w.overhead+w.overhead)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := w.prepare(); err != nil {
+		return err
+	}
+	// zero payload length
+	w.Seal(buf[:0], w.nonce, buf[:2], nil)
+	increaseNonce(w.nonce)
+	// empty payload
+	w.Seal(buf[2+w.overhead:2+w.overhead], w.nonce, nil, nil)
+	increaseNonce(w.nonce)
+	w.records++
+	nw, err := w.Writer.Write(buf)
+	if err != nil {
+		w.pending = buf[nw:]
+	}
+	w.touch(false)
+	return err
+}
+
+// SetRekey rekeys with new salt after records written with a subkey, or before nonce is exhausted, 0 disables
+// subkey of new salt is derived by Cipher, peer must support rekey records, like StreamReader with Cipher does
+func (w *StreamWriter) SetRekey(c Cipher, records uint64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.keys, w.rekeyAfter = c, records
+}
+
+// prepare flushes pending bytes and rekeys if needed before writing a record, w.lock must be held
+func (w *StreamWriter) prepare() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	// a record takes 2 nonces, rekey before the last record
+	if w.keys != nil && w.rekeyAfter > 0 && (w.records >= w.rekeyAfter || !nonceAvailable(w.nonce, 4)) {
+		if err := w.rekey(); err != nil {
+			return err
+		}
+	}
+	if !nonceAvailable(w.nonce, 2) {
+		return ErrNonceExhausted
+	}
+	return nil
+}
+
+// rekey writes a rekey record with new salt, and switches to subkey of new salt, w.lock must be held
+func (w *StreamWriter) rekey() error {
+	salt := make([]byte, w.keys.SaltSize())
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	a, err := w.keys.CreateAEAD(salt)
+	if err != nil {
+		return err
+	}
+	// records are sized by overhead before taking lock
+	if a.Overhead() != w.overhead {
+		return ErrRekeyNotSupported
+	}
+	buf := make([]byte, 2+w.Overhead()+len(salt)+w.Overhead())
+	buf[0], buf[1] = byte((rekeyFlag|len(salt))>>8), byte(len(salt))
+	w.Seal(buf[:0], w.nonce, buf[:2], nil)
+	increaseNonce(w.nonce)
+	w.Seal(buf[2+w.Overhead():2+w.Overhead()], w.nonce, salt, nil)
+	increaseNonce(w.nonce)
+	// rekey record is committed, switch subkey even if it is interrupted
+	w.AEAD, w.nonce, w.records = a, make([]byte, a.NonceSize()), 0
+	nw, err := w.Writer.Write(buf)
+	if err != nil {
+		w.pending = buf[nw:]
+	}
+	return err
+}
+
+// Flush writes remainder of record interrupted by previous error
+func (w *StreamWriter) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.flush()
+}
+
+func (w *StreamWriter) flush() error {
+	for len(w.pending) > 0 {
+		nw, err := w.Writer.Write(w.pending)
+		w.pending = w.pending[nw:]
+		if err != nil {
+			return err
+		}
+	}
+	w.pending = nil
+	return nil
+}
+
+// touch records time of last write, and of last non-empty write if payload is true
+func (w *StreamWriter) touch(payload bool) {
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&w.lastWrite, now)
+	if payload && w.activity != nil {
+		atomic.StoreInt64(w.activity, now)
+	}
+}
+
 // StreamReader reads a encrypted io.Reader and decrypt
 type StreamReader struct {
 	io.Reader
@@ -85,6 +258,23 @@ type StreamReader struct {
 	buf    []byte
 	nonce  []byte
 	debris []byte
+	// traffic accounting
+	meter *meter
+	user  string
+	// rate limiting
+	limiters []*Limiter
+	// cipher name for metrics
+	cipher string
+	// unix nano of last non-empty record, shared with StreamWriter
+	activity *int64
+	// progress of a record interrupted by error like timeout, reading resumes from it
+	// bytes read of current chunk, and payload size, -1 before length chunk is decrypted
+	pos  int
+	size int
+	// current record is a rekey record
+	rekeying bool
+	// derives subkey of new salt in rekey records, nil rejects rekey records
+	keys Cipher
 }
 
 // NewStreamReader Create a New StreamReader
@@ -94,35 +284,97 @@ func NewStreamReader(r io.Reader, a cipher.AEAD) *StreamReader {
 		AEAD:   a,
 		buf:    make([]byte, PayloadMaxSize+a.Overhead()),
 		nonce:  make([]byte, a.NonceSize()),
+		size:   -1,
 	}
 }
 
-func (r *StreamReader) internalRead() (int, error) {
-	// decrypt payload size
-	buf := r.buf[:2+r.Overhead()]
-	_, err := io.ReadFull(r.Reader, buf)
+// SetRekey accepts rekey records, subkey of new salt is derived by Cipher, nil rejects them
+// should be called before first Read
+func (r *StreamReader) SetRekey(c Cipher) {
+	r.keys = c
+}
+
+// readChunk fills buf, resuming from previous interrupted read
+func (r *StreamReader) readChunk(buf []byte) error {
+	n, err := io.ReadFull(r.Reader, buf[r.pos:])
+	r.pos += n
 	if err != nil {
+		// EOF is only OK between records
+		if err == io.EOF && (r.pos > 0 || r.size >= 0) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	r.pos = 0
+	return nil
+}
+
+func (r *StreamReader) internalRead() (int, error) {
+	if r.size < 0 {
+		// decrypt payload size
+		buf := r.buf[:2+r.Overhead()]
+		if err := r.readChunk(buf); err != nil {
+			return 0, err
+		}
+		if !nonceAvailable(r.nonce, 2) {
+			return 0, ErrNonceExhausted
+		}
+
+		_, err := r.Open(buf[:0], r.nonce, buf, nil)
+		increaseNonce(r.nonce)
+		if err != nil {
+			r.meter.authFailure(r.user)
+			currentMetrics().authFailure()
+			return 0, err
+		}
+
+		r.rekeying = buf[0]&(rekeyFlag>>8) != 0
+		if r.rekeying && r.keys == nil {
+			return 0, ErrRekeyNotSupported
+		}
+		r.size = (int(buf[0])<<8 + int(buf[1])) & PayloadMaxSize
+	}
+
+	// decrypt payload
+	size := r.size
+	buf := r.buf[:size+r.Overhead()]
+	if err := r.readChunk(buf); err != nil {
 		return 0, err
 	}
+	r.size = -1
 
-	_, err = r.Open(buf[:0], r.nonce, buf, nil)
+	// wait for rate limiters
+	waitAll(r.limiters, 2+r.Overhead()+len(buf))
+
+	_, err := r.Open(buf[:0], r.nonce, buf, nil)
 	increaseNonce(r.nonce)
 	if err != nil {
+		r.meter.authFailure(r.user)
+		currentMetrics().authFailure()
 		return 0, err
 	}
 
-	size := (int(buf[0])<<8 + int(buf[1])) & PayloadMaxSize
+	// switch to subkey of new salt
+	if r.rekeying {
+		a, err := r.keys.CreateAEAD(buf[:size])
+		if err != nil {
+			return 0, err
+		}
+		r.AEAD, r.nonce, r.rekeying = a, make([]byte, a.NonceSize()), false
+		return 0, nil
+	}
 
-	// decrypt payload
-	buf = r.buf[:size+r.Overhead()]
-	_, err = io.ReadFull(r.Reader, buf)
-	if err != nil {
-		return 0, err
+	// empty records are keepalives
+	if size == 0 {
+		return 0, nil
+	}
+	if r.activity != nil {
+		atomic.StoreInt64(r.activity, time.Now().UnixNano())
 	}
 
-	_, err = r.Open(buf[:0], r.nonce, buf, nil)
-	increaseNonce(r.nonce)
-	if err != nil {
+	// count and check quota
+	currentMetrics().recordIn(r.cipher, size)
+	if err = r.meter.in(r.user, size); err != nil {
 		return 0, err
 	}
 
@@ -138,7 +390,11 @@ func (r *StreamReader) Read(b []byte) (int, error) {
 		return n, nil
 	}
 
+	// skip empty records
 	n, err := r.internalRead()
+	for n == 0 && err == nil {
+		n, err = r.internalRead()
+	}
 	m := copy(b, r.buf[:n])
 	if m < n { // insufficient len(b), keep debris for next read
 		r.debris = r.buf[m:n]
@@ -182,56 +438,393 @@ func (r *StreamReader) WriteTo(w io.Writer) (n int64, err error) {
 }
 
 // StreamConn wraps a net.Conn with automatically encryption and decryption
+//
+// StreamConn is safe for concurrent use: Read/WriteTo and Write/ReadFrom may run concurrently in
+// different goroutines, calls in the same direction are serialized, and Close may be called at any time
+// to interrupt blocking calls. Salt exchange is initialized lazily by the first call of each direction,
+// or eagerly by Handshake. With HandshakeCipher, both directions are initialized together by key exchange.
+// Setters like SetStats should be called before first Read or Write.
 type StreamConn struct {
 	net.Conn
 	Cipher
 	w *StreamWriter
 	r *StreamReader
+	// server side of HandshakeCipher
+	server bool
+	// for multi-user StreamConn
+	users *MultiUserCipher
+	user  string
+	// traffic accounting
+	meter meter
+	// rate limiting
+	limiters     []*Limiter
+	userLimiters *UserLimiters
+	// 1 if counted as active in metrics, 2 if closed
+	active int32
+	// guard lazy initialization of r and w, winit is acquired before rinit
+	rinit sync.Mutex
+	winit sync.Mutex
+	// serialize Read/WriteTo and Write/ReadFrom respectively
+	rlock sync.Mutex
+	wlock sync.Mutex
+	// salt, or salt and first length chunk for multi-user StreamConn, read so far
+	head []byte
+	// keepalive records and idle timeout
+	keepAliveRecords time.Duration
+	idleTimeout      time.Duration
+	activity         int64
+	monitorOnce      sync.Once
+	done             chan struct{}
+	closed           int32
+	// 1 while a keepalive record is being written
+	keepAliveBusy int32
+	// *StreamWriter once initialized, read by monitor without winit held during blocking initialization
+	wready atomic.Value
+	// rekey after records written
+	rekeyRecords uint64
+	// deadlines set by caller, restored after Handshake
+	dlock     sync.Mutex
+	rdeadline time.Time
+	wdeadline time.Time
 }
 
 // NewStreamConn create a new StreamConn
 func NewStreamConn(conn net.Conn, c Cipher) *StreamConn {
-	return &StreamConn{
-		Conn:   conn,
-		Cipher: c,
+	sc := &StreamConn{Conn: conn, Cipher: c}
+	// closed through StreamConn on quota exceeded, so metrics are updated
+	sc.meter.closer = sc
+	return sc
+}
+
+// NewServerStreamConn create a new StreamConn for accepted connection, the server side of HandshakeCipher
+func NewServerStreamConn(conn net.Conn, c Cipher) *StreamConn {
+	sc := NewStreamConn(conn, c)
+	sc.server = true
+	return sc
+}
+
+// SetStats aggregates traffic of this StreamConn to Stats, and enforces quota
+// should be called before first Read or Write
+func (c *StreamConn) SetStats(s *Stats) {
+	c.meter.stats = s
+}
+
+// Stats returns traffic counters of this StreamConn
+func (c *StreamConn) Stats() StatsSnapshot {
+	return c.meter.Snapshot()
+}
+
+// SetLimiters limits read and write throughput with Limiter, limiters can be shared
+// should be called before first Read or Write
+func (c *StreamConn) SetLimiters(ls ...*Limiter) {
+	c.limiters = ls
+}
+
+// SetUserLimiters limits read and write throughput with Limiter of user
+// should be called before first Read or Write
+func (c *StreamConn) SetUserLimiters(u *UserLimiters) {
+	c.userLimiters = u
+}
+
+// tcpKeepAliver is implemented by connections supporting TCP keepalive, like *net.TCPConn
+type tcpKeepAliver interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// SetKeepAlive enables TCP keepalive of underlying net.Conn with period, 0 disables
+// ignored if underlying net.Conn does not support TCP keepalive
+func (c *StreamConn) SetKeepAlive(period time.Duration) error {
+	ka, ok := c.Conn.(tcpKeepAliver)
+	if !ok {
+		return nil
+	}
+	if period <= 0 {
+		return ka.SetKeepAlive(false)
+	}
+	if err := ka.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return ka.SetKeepAlivePeriod(period)
+}
+
+// SetKeepAliveRecords sends an empty record if nothing is written for interval, 0 disables
+// StreamReader discards empty records, but peers of other implementations may not, enable it only with FleeGrid peers
+// should be called before first Read or Write
+func (c *StreamConn) SetKeepAliveRecords(interval time.Duration) {
+	c.keepAliveRecords = interval
+}
+
+// SetRekey rekeys in-band with new salt after records written with a subkey, 0 disables
+// when disabled, writing fails with ErrNonceExhausted instead of reusing nonces
+// StreamReader accepts rekey records, but peers of other implementations may not, enable it only with FleeGrid peers
+// should be called before first Write
+func (c *StreamConn) SetRekey(records uint64) {
+	c.rekeyRecords = records
+}
+
+// SetIdleTimeout closes StreamConn if no data is read or written for timeout, keepalive records are not counted, 0 disables
+// should be called before first Read or Write
+func (c *StreamConn) SetIdleTimeout(timeout time.Duration) {
+	c.idleTimeout = timeout
+}
+
+// startMonitor starts a goroutine for keepalive records and idle timeout if enabled
+func (c *StreamConn) startMonitor() {
+	c.monitorOnce.Do(func() {
+		if c.keepAliveRecords <= 0 && c.idleTimeout <= 0 {
+			return
+		}
+		atomic.StoreInt64(&c.activity, time.Now().UnixNano())
+		c.done = make(chan struct{})
+		go c.monitor(c.done)
+	})
+}
+
+// monitor sends keepalive records and checks idle timeout, until StreamConn is closed
+func (c *StreamConn) monitor(done chan struct{}) {
+	period := c.keepAliveRecords
+	if period <= 0 || (c.idleTimeout > 0 && c.idleTimeout < period) {
+		period = c.idleTimeout
+	}
+	ticker := time.NewTicker(period / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		now := time.Now()
+		if c.idleTimeout > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&c.activity))) >= c.idleTimeout {
+			c.Close()
+			return
+		}
+		if c.keepAliveRecords <= 0 {
+			continue
+		}
+		w, _ := c.wready.Load().(*StreamWriter)
+		if w != nil && now.Sub(time.Unix(0, atomic.LoadInt64(&w.lastWrite))) >= c.keepAliveRecords &&
+			atomic.CompareAndSwapInt32(&c.keepAliveBusy, 0, 1) {
+			// written in a goroutine, a write blocked by peer must not stall idle timeout
+			go func() {
+				w.WriteKeepAlive()
+				atomic.StoreInt32(&c.keepAliveBusy, 0)
+			}()
+		}
 	}
 }
 
+// newReader create a StreamReader with accounting and rate limiting
+func (c *StreamConn) newReader(r io.Reader, a cipher.AEAD) *StreamReader {
+	sr := NewStreamReader(r, a)
+	sr.meter, sr.user = &c.meter, c.user
+	sr.limiters = c.userLimiters.limitersOf(c.limiters, c.user)
+	sr.cipher = cipherName(c.Cipher)
+	sr.activity = &c.activity
+	sr.SetRekey(c.Cipher)
+	return sr
+}
+
+// newWriter create a StreamWriter with accounting and rate limiting
+func (c *StreamConn) newWriter(w io.Writer, a cipher.AEAD) *StreamWriter {
+	sw := NewStreamWriter(w, a)
+	sw.meter, sw.user = &c.meter, c.user
+	sw.limiters = c.userLimiters.limitersOf(c.limiters, c.user)
+	sw.cipher = cipherName(c.Cipher)
+	sw.activity = &c.activity
+	sw.lastWrite = time.Now().UnixNano()
+	sw.keys, sw.rekeyAfter = c.Cipher, c.rekeyRecords
+	return sw
+}
+
+// opened counts StreamConn as active in metrics, and starts monitor
+func (c *StreamConn) opened() {
+	c.startMonitor()
+	if m := currentMetrics(); m != nil && atomic.CompareAndSwapInt32(&c.active, 0, 1) {
+		m.connectionOpened()
+	}
+}
+
+// Close closes underlying net.Conn
+func (c *StreamConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.active, 1, 2) {
+		currentMetrics().connectionClosed()
+	}
+	// stop monitor, and prevent it from starting
+	c.monitorOnce.Do(func() {})
+	if c.done != nil && atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		close(c.done)
+	}
+	return c.Conn.Close()
+}
+
+// accepted counts a finished handshake of server side, latency is measured from first byte received
+func (c *StreamConn) accepted(first *firstByteReader) {
+	if !c.server || first.at.IsZero() {
+		return
+	}
+	d := time.Since(first.at)
+	c.meter.handshake(c.user, d)
+	currentMetrics().connectionAccepted(d)
+}
+
+// firstByteReader records time of first byte read, so waiting for an idle client is not counted
+type firstByteReader struct {
+	io.Reader
+	at time.Time
+}
+
+func (r *firstByteReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 && r.at.IsZero() {
+		r.at = time.Now()
+	}
+	return n, err
+}
+
 func (c *StreamConn) initReader() error {
-	salt := make([]byte, c.SaltSize())
-	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+	c.opened()
+	first := &firstByteReader{Reader: c.Conn}
+	// bytes read before an error like timeout are kept in head
+	if len(c.head) > 0 {
+		first.at = time.Now()
+	}
+	if c.users != nil {
+		u, r, a, err := c.users.openStream(first, &c.head)
+		if err != nil {
+			if err == ErrNoMatchingUser {
+				c.meter.authFailure("")
+				currentMetrics().saltRejected()
+			}
+			return err
+		}
+		c.Cipher, c.user = u.Cipher, u.user
+		if a == nil {
+			return c.initHandshake(u.Cipher.(HandshakeCipher), r, false, first)
+		}
+		c.r = c.newReader(r, a)
+		c.accepted(first)
+		return nil
+	}
+
+	if hc, ok := c.Cipher.(HandshakeCipher); ok {
+		return c.initHandshake(hc, first, !c.server, first)
+	}
+
+	// salt read so far is kept in head, reading resumes after error like timeout
+	if err := readAtLeast(first, &c.head, c.SaltSize()); err != nil {
 		return err
 	}
+	salt := c.head[:c.SaltSize()]
+	c.head = nil
 
 	a, err := c.CreateAEAD(salt)
 	if err != nil {
 		return err
 	}
 
-	c.r = NewStreamReader(c.Conn, a)
+	c.r = c.newReader(c.Conn, a)
+	c.accepted(first)
 	return nil
 }
 
-func (c *StreamConn) Read(b []byte) (int, error) {
+// initHandshake initializes both directions by key exchange, winit and rinit must be held
+// first records the first byte of r, or nil if r is not read yet
+func (c *StreamConn) initHandshake(hc HandshakeCipher, r io.Reader, client bool, first *firstByteReader) error {
+	if first == nil {
+		first = &firstByteReader{Reader: r}
+		r = first
+	}
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{r, c.Conn}
+	wa, ra, session, err := hc.Handshake(rw, client)
+	if err != nil {
+		if err == ErrHandshakeFailed && !client {
+			c.meter.authFailure(c.user)
+			currentMetrics().authFailure()
+		}
+		return err
+	}
+	c.r, c.w = c.newReader(r, ra), c.newWriter(c.Conn, wa)
+	// rekey with subkeys of session, pre-shared key alone is not forward-secret
+	c.r.keys, c.w.keys = session, session
+	c.wready.Store(c.w)
+	c.accepted(first)
+	return nil
+}
+
+// reader returns StreamReader, initializes it if needed
+func (c *StreamConn) reader() (*StreamReader, error) {
+	// handshake initializes writer as well
+	if c.mayHandshake() {
+		c.winit.Lock()
+		defer c.winit.Unlock()
+	}
+	return c.readerLocked()
+}
+
+// mayHandshake reports if HandshakeCipher is used, users of multi-user StreamConn may use it
+func (c *StreamConn) mayHandshake() bool {
+	if c.users != nil {
+		return true
+	}
+	_, ok := c.Cipher.(HandshakeCipher)
+	return ok
+}
+
+// readerLocked see reader, winit must be held if writer may be initialized
+func (c *StreamConn) readerLocked() (*StreamReader, error) {
+	c.rinit.Lock()
+	defer c.rinit.Unlock()
 	if c.r == nil {
 		if err := c.initReader(); err != nil {
-			return 0, err
+			return nil, err
 		}
 	}
-	return c.r.Read(b)
+	return c.r, nil
+}
+
+func (c *StreamConn) Read(b []byte) (int, error) {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+	r, err := c.reader()
+	if err != nil {
+		return 0, err
+	}
+	return r.Read(b)
 }
 
 // WriteTo see StreamReader#WriteTo
 func (c *StreamConn) WriteTo(w io.Writer) (int64, error) {
-	if c.r == nil {
-		if err := c.initReader(); err != nil {
-			return 0, err
-		}
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+	r, err := c.reader()
+	if err != nil {
+		return 0, err
 	}
-	return c.r.WriteTo(w)
+	return r.WriteTo(w)
 }
 
 func (c *StreamConn) initWriter() error {
+	c.opened()
+	// multi-user StreamConn must identify user first
+	if c.users != nil {
+		if _, err := c.readerLocked(); err != nil {
+			return err
+		}
+		// initialized by handshake
+		if c.w != nil {
+			return nil
+		}
+	} else if hc, ok := c.Cipher.(HandshakeCipher); ok {
+		c.rinit.Lock()
+		defer c.rinit.Unlock()
+		return c.initHandshake(hc, c.Conn, !c.server, nil)
+	}
+
 	salt := make([]byte, c.SaltSize())
 	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
 		return err
@@ -240,34 +833,150 @@ func (c *StreamConn) initWriter() error {
 	if err != nil {
 		return err
 	}
-	_, err = c.Conn.Write(salt)
-	if err != nil {
-		return err
-	}
-	c.w = NewStreamWriter(c.Conn, a)
+	// salt is sent with first record, or by Handshake
+	c.w = c.newWriter(c.Conn, a)
+	c.w.pending = salt
+	c.wready.Store(c.w)
 	return nil
 }
 
-func (c *StreamConn) Write(b []byte) (int, error) {
+// writer returns StreamWriter, initializes it if needed
+func (c *StreamConn) writer() (*StreamWriter, error) {
+	c.winit.Lock()
+	defer c.winit.Unlock()
 	if c.w == nil {
 		if err := c.initWriter(); err != nil {
-			return 0, err
+			return nil, err
 		}
 	}
-	return c.w.Write(b)
+	return c.w, nil
+}
+
+func (c *StreamConn) Write(b []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	w, err := c.writer()
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(b)
 }
 
 // ReadFrom see StreamWriter#ReadFrom
 func (c *StreamConn) ReadFrom(r io.Reader) (int64, error) {
-	if c.w == nil {
-		if err := c.initWriter(); err != nil {
-			return 0, err
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	w, err := c.writer()
+	if err != nil {
+		return 0, err
+	}
+	return w.ReadFrom(r)
+}
+
+// Handshake sends local salt and reads salt of peer eagerly, instead of on first Write and Read
+// client sends an empty record with its salt, so multi-user server can identify user, see WriteKeepAlive
+// server reads salt of client first, and sends its salt once client is identified
+// ctx cancels handshake by setting deadline of underlying net.Conn, deadlines set by SetDeadline are restored afterwards
+// handshake can be retried after timeout or cancellation, except with HandshakeCipher
+func (c *StreamConn) Handshake(ctx context.Context) error {
+	c.dlock.Lock()
+	rd, wd := c.rdeadline, c.wdeadline
+	c.dlock.Unlock()
+	touched := false
+	if deadline, ok := ctx.Deadline(); ok {
+		c.Conn.SetReadDeadline(earlier(rd, deadline))
+		c.Conn.SetWriteDeadline(earlier(wd, deadline))
+		touched = true
+	}
+	stop := make(chan struct{})
+	cancelled := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// interrupt blocking I/O
+			c.Conn.SetDeadline(time.Unix(1, 0))
+			cancelled <- true
+		case <-stop:
+			cancelled <- false
 		}
+	}()
+
+	err := c.handshake()
+	close(stop)
+	if <-cancelled || touched {
+		c.Conn.SetReadDeadline(rd)
+		c.Conn.SetWriteDeadline(wd)
 	}
-	return c.w.ReadFrom(r)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
 }
 
-// increase little-endian nonce with unspecified length, preventing overflow
+func (c *StreamConn) handshake() error {
+	// server identifies client first, salt is not sent to unauthenticated peers
+	if c.server {
+		if _, err := c.reader(); err != nil {
+			return err
+		}
+	}
+	w, err := c.writer()
+	if err != nil {
+		return err
+	}
+	if !c.server && !c.mayHandshake() {
+		err = w.WriteKeepAlive()
+	} else {
+		err = w.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	_, err = c.reader()
+	return err
+}
+
+// earlier returns the earlier deadline, zero means no deadline
+func earlier(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// SetDeadline sets read and write deadlines of underlying net.Conn, they are restored after Handshake
+func (c *StreamConn) SetDeadline(t time.Time) error {
+	c.dlock.Lock()
+	defer c.dlock.Unlock()
+	c.rdeadline, c.wdeadline = t, t
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets read deadline of underlying net.Conn, see SetDeadline
+func (c *StreamConn) SetReadDeadline(t time.Time) error {
+	c.dlock.Lock()
+	defer c.dlock.Unlock()
+	c.rdeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets write deadline of underlying net.Conn, see SetDeadline
+func (c *StreamConn) SetWriteDeadline(t time.Time) error {
+	c.dlock.Lock()
+	defer c.dlock.Unlock()
+	c.wdeadline = t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// User returns user identified by multi-user StreamConn, empty before first Read
+// blocks while salt of peer is being read
+func (c *StreamConn) User() string {
+	c.rinit.Lock()
+	defer c.rinit.Unlock()
+	return c.user
+}
+
+// increase little-endian nonce with unspecified length, see nonceAvailable for overflow
 func increaseNonce(nonce []byte) {
 	for i := range nonce {
 		nonce[i]++
@@ -276,3 +985,17 @@ func increaseNonce(nonce []byte) {
 		}
 	}
 }
+
+// nonceAvailable reports whether n more nonces can be used before little-endian nonce wraps around
+// the last nonce value is never used, so a wrapped nonce is never mistaken for a fresh one
+func nonceAvailable(nonce []byte, n int) bool {
+	// nonce + n must not overflow
+	carry := n
+	for _, b := range nonce {
+		if carry == 0 {
+			return true
+		}
+		carry = (int(b) + carry) >> 8
+	}
+	return carry == 0
+}
@@ -2,14 +2,20 @@ package core
 
 import (
 	"bytes"
+	"context"
+	"crypto/cipher"
 	"encoding/hex"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"sync"
 	"testing"
+	"time"
 )
 
 const streamAddr = ":12301"
+const streamHandshakeAddr = ":12334"
 
 func randomPayloadString() string {
 	bytes := make([]byte, PayloadMaxSize/2+rand.Intn(PayloadMaxSize))
@@ -31,9 +37,7 @@ func TestStreamConn(t *testing.T) {
 		t.Fatalf("Cannot listen socket")
 	}
 
-	sconnReady := make(chan bool, 1)
-
-	var sconn *StreamConn
+	sconnReady := make(chan *StreamConn, 1)
 
 	// server side
 	go func() {
@@ -41,8 +45,7 @@ func TestStreamConn(t *testing.T) {
 			conn, err := l.Accept()
 			if err == nil {
 				go func() {
-					sconn = NewStreamConn(conn, c)
-					sconnReady <- true
+					sconnReady <- NewStreamConn(conn, c)
 				}()
 			} else {
 				break
@@ -59,7 +62,7 @@ func TestStreamConn(t *testing.T) {
 
 		cconn := NewStreamConn(conn, c)
 
-		<-sconnReady
+		sconn := <-sconnReady
 
 		str := randomPayloadString()
 
@@ -83,3 +86,504 @@ func TestStreamConn(t *testing.T) {
 
 	l.Close()
 }
+
+func TestStreamKeepAlive(t *testing.T) {
+	c, _ := NewCipher("AEAD_CHACHA20_POLY1305", "hello")
+	c1, c2 := net.Pipe()
+	cconn := NewStreamConn(c1, c)
+	sconn := NewStreamConn(c2, c)
+	defer cconn.Close()
+	defer sconn.Close()
+	cconn.SetKeepAliveRecords(20 * time.Millisecond)
+
+	go func() {
+		cconn.Write([]byte("hello"))
+		// several keepalive records in between
+		time.Sleep(100 * time.Millisecond)
+		cconn.Write([]byte("world"))
+		cconn.Close()
+	}()
+
+	res, err := ioutil.ReadAll(sconn)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if string(res) != "helloworld" {
+		t.Fatalf("Str mismatch: %q", res)
+	}
+	if s := sconn.Stats(); s.RecordsIn != 2 || s.BytesIn != 10 {
+		t.Fatalf("Keepalive records should not be counted: %+v", s)
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	c, _ := NewCipher("AEAD_CHACHA20_POLY1305", "hello")
+	c1, c2 := net.Pipe()
+	cconn := NewStreamConn(c1, c)
+	sconn := NewStreamConn(c2, c)
+	defer cconn.Close()
+	defer sconn.Close()
+	// keepalive records of peer do not count as traffic
+	cconn.SetKeepAliveRecords(10 * time.Millisecond)
+	sconn.SetIdleTimeout(80 * time.Millisecond)
+
+	go cconn.Write([]byte("hello"))
+	start := time.Now()
+	res := make([]byte, 5)
+	if _, err := sconn.Read(res); err != nil || string(res) != "hello" {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if _, err := sconn.Read(res); err == nil {
+		t.Fatal("Should be closed by idle timeout")
+	}
+	if d := time.Since(start); d < 80*time.Millisecond || d > time.Second {
+		t.Fatalf("Idle timeout mismatch: %v", d)
+	}
+}
+
+func TestStreamIdleTimeoutBlockedKeepAlive(t *testing.T) {
+	c, _ := NewCipher("AEAD_CHACHA20_POLY1305", "hello")
+	c1, c2 := net.Pipe()
+	cconn := NewStreamConn(c1, c)
+	defer cconn.Close()
+	defer c2.Close()
+	cconn.SetKeepAliveRecords(10 * time.Millisecond)
+	cconn.SetIdleTimeout(80 * time.Millisecond)
+
+	// peer reads the first record only, keepalive records block
+	go io.ReadFull(c2, make([]byte, c.SaltSize()+2+16+5+16))
+	if _, err := cconn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := cconn.Read(make([]byte, 5))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Should be closed by idle timeout")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Idle timeout should fire while keepalive is blocked")
+	}
+}
+
+func TestStreamIdleTimeoutSilentPeer(t *testing.T) {
+	users, _ := createTestUsers(t)
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	sconn := NewMultiUserStreamConn(c2, users)
+	defer sconn.Close()
+	sconn.SetKeepAliveRecords(10 * time.Millisecond)
+	sconn.SetIdleTimeout(80 * time.Millisecond)
+
+	// peer never sends salt, user is identified while winit is held
+	done := make(chan error, 1)
+	go func() {
+		_, err := sconn.Read(make([]byte, 5))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Should be closed by idle timeout")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Idle timeout should fire while salt of peer is awaited")
+	}
+}
+
+// timeoutReader reads at most 7 bytes at a time, and times out every other read
+type timeoutReader struct {
+	r       io.Reader
+	timeout bool
+}
+
+func (r *timeoutReader) Read(b []byte) (int, error) {
+	r.timeout = !r.timeout
+	if len(b) > 7 {
+		b = b[:7]
+	}
+	n, err := r.r.Read(b)
+	if err == nil && r.timeout {
+		err = &net.OpError{Op: "read", Net: "tcp", Err: errTimeout{}}
+	}
+	return n, err
+}
+
+// timeoutWriter writes at most 1000 bytes at a time, and times out if truncated
+type timeoutWriter struct {
+	bytes.Buffer
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	if len(b) > 1000 {
+		w.Buffer.Write(b[:1000])
+		return 1000, &net.OpError{Op: "write", Net: "tcp", Err: errTimeout{}}
+	}
+	return w.Buffer.Write(b)
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func TestStreamResumeAfterTimeout(t *testing.T) {
+	c, _ := NewCipher("AEAD_CHACHA20_POLY1305", "hello")
+	salt := make([]byte, c.SaltSize())
+	str := []byte(randomPayloadString())
+
+	// writer retries after timeout
+	a, _ := c.CreateAEAD(salt)
+	tw := &timeoutWriter{}
+	w := NewStreamWriter(tw, a)
+	for b := str; len(b) > 0; {
+		n, err := w.Write(b)
+		if err != nil && !isTimeout(err) {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		b = b[n:]
+	}
+	for err := w.Flush(); err != nil; err = w.Flush() {
+		if !isTimeout(err) {
+			t.Fatalf("Failed to flush: %v", err)
+		}
+	}
+
+	// reader retries after timeout
+	a, _ = c.CreateAEAD(salt)
+	r := NewStreamReader(&timeoutReader{r: &tw.Buffer}, a)
+	var res []byte
+	buf := make([]byte, 1024)
+	for {
+		n, err := r.Read(buf)
+		res = append(res, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && !isTimeout(err) {
+			t.Fatalf("Failed to read: %v", err)
+		}
+	}
+	if !bytes.Equal(res, str) {
+		t.Fatal("Str mismatch")
+	}
+}
+
+func TestStreamHandshake(t *testing.T) {
+	c, _ := NewCipher("AEAD_CHACHA20_POLY1305", "hello")
+	l, err := net.Listen("tcp", "127.0.0.1"+streamHandshakeAddr)
+	if err != nil {
+		t.Fatalf("Cannot listen socket: %v", err)
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1"+streamHandshakeAddr)
+	if err != nil {
+		t.Fatalf("Cannot dial socket: %v", err)
+	}
+	cconn := NewStreamConn(conn, c)
+	defer cconn.Close()
+	rconn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Cannot accept socket: %v", err)
+	}
+	sconn := NewStreamConn(rconn, c)
+	defer sconn.Close()
+
+	// peer is silent, timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = cconn.Handshake(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Handshake should timeout: %v", err)
+	}
+
+	// cancelled
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err = cconn.Handshake(ctx); err != context.Canceled {
+		t.Fatalf("Handshake should be cancelled: %v", err)
+	}
+
+	// retry succeeds after peer handshakes
+	go sconn.Handshake(context.Background())
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = cconn.Handshake(ctx); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+
+	str := randomPayloadString()
+	go cconn.Write([]byte(str))
+	res := make([]byte, len(str))
+	if _, err = io.ReadFull(sconn, res); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if string(res) != str {
+		t.Fatal("Str mismatch")
+	}
+}
+
+func TestStreamRekeyKeepAlive(t *testing.T) {
+	c, _ := NewCipher("AEAD_AES_256_GCM", "hello")
+	c1, c2 := net.Pipe()
+	cconn := NewStreamConn(c1, c)
+	sconn := NewStreamConn(c2, c)
+	defer sconn.Close()
+	// keepalive records rekey in monitor, while ReadFrom writes records
+	cconn.SetRekey(1)
+	cconn.SetKeepAliveRecords(2 * time.Millisecond)
+
+	str := randomPayloadString()
+	pr, pw := io.Pipe()
+	go func() {
+		for b := []byte(str); len(b) > 0; {
+			n := len(b)
+			if n > 1000 {
+				n = 1000
+			}
+			pw.Write(b[:n])
+			b = b[n:]
+			time.Sleep(time.Millisecond)
+		}
+		pw.Close()
+	}()
+	go func() {
+		cconn.ReadFrom(pr)
+		cconn.Close()
+	}()
+	res, err := ioutil.ReadAll(sconn)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if string(res) != str {
+		t.Fatal("Str mismatch")
+	}
+}
+
+func TestStreamConnConcurrent(t *testing.T) {
+	users, ciphers := createTestUsers(t)
+	c1, c2 := net.Pipe()
+	cconn := NewStreamConn(c1, ciphers["carol"])
+	sconn := NewMultiUserStreamConn(c2, users)
+
+	const writers = 4
+	const size = 3 * PayloadMaxSize
+
+	// server reads with two goroutines, while the first Write initializes reader concurrently
+	var lock sync.Mutex
+	counts := map[byte]int{}
+	var rwg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		rwg.Add(1)
+		go func() {
+			defer rwg.Done()
+			buf := make([]byte, 1000)
+			for {
+				n, err := sconn.Read(buf)
+				lock.Lock()
+				for _, b := range buf[:n] {
+					counts[b]++
+				}
+				lock.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	replied := make(chan error, 1)
+	go func() {
+		_, err := sconn.Write([]byte("hello"))
+		replied <- err
+	}()
+
+	// client reads reply while writing concurrently
+	received := make(chan string, 1)
+	go func() {
+		var buf bytes.Buffer
+		cconn.WriteTo(&buf)
+		received <- buf.String()
+	}()
+	var wwg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wwg.Add(1)
+		go func(b byte) {
+			defer wwg.Done()
+			cconn.Write(bytes.Repeat([]byte{b}, size))
+		}(byte(i))
+	}
+	wwg.Wait()
+	if err := <-replied; err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if sconn.User() != "carol" {
+		t.Fatalf("User mismatch: %s", sconn.User())
+	}
+
+	// wait until all bytes are read, then Close interrupts blocking reads
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		lock.Lock()
+		n := 0
+		for _, c := range counts {
+			n += c
+		}
+		lock.Unlock()
+		if n == writers*size {
+			break
+		}
+	}
+	sconn.Close()
+	rwg.Wait()
+	cconn.Close()
+	if s := <-received; s != "hello" {
+		t.Fatalf("Reply mismatch: %q", s)
+	}
+	for i := 0; i < writers; i++ {
+		if counts[byte(i)] != size {
+			t.Fatalf("Bytes of writer %d mismatch: %d", i, counts[byte(i)])
+		}
+	}
+}
+
+// smallNonceAEAD exhausts nonce after 255 uses
+type smallNonceAEAD struct {
+	cipher.AEAD
+}
+
+func (a smallNonceAEAD) NonceSize() int {
+	return 1
+}
+
+func (a smallNonceAEAD) pad(nonce []byte) []byte {
+	n := make([]byte, a.AEAD.NonceSize())
+	copy(n, nonce)
+	return n
+}
+
+func (a smallNonceAEAD) Seal(dst, nonce, plaintext, ad []byte) []byte {
+	return a.AEAD.Seal(dst, a.pad(nonce), plaintext, ad)
+}
+
+func (a smallNonceAEAD) Open(dst, nonce, ciphertext, ad []byte) ([]byte, error) {
+	return a.AEAD.Open(dst, a.pad(nonce), ciphertext, ad)
+}
+
+// smallNonceCipher creates smallNonceAEAD
+type smallNonceCipher struct {
+	Cipher
+}
+
+func (c smallNonceCipher) CreateAEAD(salt []byte) (cipher.AEAD, error) {
+	a, err := c.Cipher.CreateAEAD(salt)
+	return smallNonceAEAD{a}, err
+}
+
+func TestNonceAvailable(t *testing.T) {
+	cases := []struct {
+		nonce []byte
+		n     int
+		ok    bool
+	}{
+		{[]byte{0xFD}, 2, true},
+		{[]byte{0xFE}, 1, true},
+		{[]byte{0xFE}, 2, false},
+		{[]byte{0xFF}, 1, false},
+		{[]byte{0xFC, 0xFF}, 3, true},
+		{[]byte{0xFD, 0xFF}, 3, false},
+		{[]byte{0xFF, 0x00}, 4, true},
+	}
+	for _, c := range cases {
+		if nonceAvailable(c.nonce, c.n) != c.ok {
+			t.Fatalf("nonceAvailable(%x, %d) should be %v", c.nonce, c.n, c.ok)
+		}
+	}
+}
+
+func TestStreamNonceExhausted(t *testing.T) {
+	c, _ := NewCipher("AEAD_CHACHA20_POLY1305", "hello")
+	sc := smallNonceCipher{c}
+	salt := make([]byte, c.SaltSize())
+	a, _ := sc.CreateAEAD(salt)
+
+	// 255 nonces, 2 for each record
+	var buf bytes.Buffer
+	w := NewStreamWriter(&buf, a)
+	for i := 0; i < 127; i++ {
+		if _, err := w.Write([]byte{byte(i)}); err != nil {
+			t.Fatalf("Failed to write record %d: %v", i, err)
+		}
+	}
+	if n, err := w.Write([]byte{0}); n != 0 || err != ErrNonceExhausted {
+		t.Fatalf("Should fail with exhausted nonce: %v", err)
+	}
+	if err := w.WriteKeepAlive(); err != ErrNonceExhausted {
+		t.Fatalf("Should fail with exhausted nonce: %v", err)
+	}
+
+	a, _ = sc.CreateAEAD(salt)
+	res, err := ioutil.ReadAll(NewStreamReader(&buf, a))
+	if err != nil || len(res) != 127 || res[126] != 126 {
+		t.Fatalf("Failed to read: %v", err)
+	}
+}
+
+func TestStreamRekey(t *testing.T) {
+	c, _ := NewCipher("AEAD_CHACHA20_POLY1305", "hello")
+	sc := smallNonceCipher{c}
+	salt := make([]byte, c.SaltSize())
+
+	// rekey by record count, and before nonce is exhausted
+	for _, records := range []uint64{10, 1000} {
+		var buf bytes.Buffer
+		a, _ := sc.CreateAEAD(salt)
+		w := NewStreamWriter(&buf, a)
+		w.SetRekey(sc, records)
+		str := []byte(randomPayloadString())
+		for i := 0; i < 300; i++ {
+			if _, err := w.Write(str[i : i+1]); err != nil {
+				t.Fatalf("Failed to write record %d: %v", i, err)
+			}
+		}
+		w.WriteKeepAlive()
+
+		// reader without Cipher rejects rekey records
+		a, _ = sc.CreateAEAD(salt)
+		if _, err := ioutil.ReadAll(NewStreamReader(bytes.NewReader(buf.Bytes()), a)); err != ErrRekeyNotSupported {
+			t.Fatalf("Should fail without Cipher: %v", err)
+		}
+
+		a, _ = sc.CreateAEAD(salt)
+		r := NewStreamReader(&buf, a)
+		r.SetRekey(sc)
+		res, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if !bytes.Equal(res, str[:300]) {
+			t.Fatal("Str mismatch")
+		}
+	}
+
+	// StreamConn
+	c1, c2 := net.Pipe()
+	cconn := NewStreamConn(c1, c)
+	sconn := NewStreamConn(c2, c)
+	defer sconn.Close()
+	cconn.SetRekey(2)
+	str := randomPayloadString()
+	go func() {
+		cconn.Write([]byte(str))
+		cconn.Close()
+	}()
+	res, err := ioutil.ReadAll(sconn)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if string(res) != str {
+		t.Fatal("Str mismatch")
+	}
+}
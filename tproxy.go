@@ -0,0 +1,172 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrTransparentNotSupported transparent proxy is only supported on Linux
+var ErrTransparentNotSupported = errors.New("transparent proxy is not supported on this platform")
+
+// TransparentProxy forwards traffic captured by iptables/nftables through ProxyDialer
+//
+// REDIRECT mode recovers TCP destination with SO_ORIGINAL_DST, TPROXY mode takes local address of
+// accepted connection as TCP destination, and IP_ORIGDSTADDR of each datagram as UDP destination.
+// UDP is only supported in TPROXY mode.
+type TransparentProxy struct {
+	// dialer for targets, usually a *Dialer
+	Dialer ProxyDialer
+	// TPROXY mode, otherwise REDIRECT mode
+	TPROXY bool
+	// idle timeout of UDP associations
+	UDPTimeout time.Duration
+}
+
+// NewTransparentProxy create a new TransparentProxy tunneling through FleeGrid server of Config
+func NewTransparentProxy(config *Config, tproxy bool) (*TransparentProxy, error) {
+	d, err := NewDialer(config)
+	if err != nil {
+		return nil, err
+	}
+	return &TransparentProxy{Dialer: d, TPROXY: tproxy}, nil
+}
+
+// ListenAndServe listens on address and serves, for both TCP and UDP in TPROXY mode
+func (p *TransparentProxy) ListenAndServe(address string) error {
+	if !p.TPROXY {
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+		return p.Serve(l)
+	}
+	l, err := ListenTransparent(address)
+	if err != nil {
+		return err
+	}
+	pc, err := ListenTransparentPacket(address)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	go p.ServePacket(pc)
+	err = p.Serve(l)
+	pc.Close()
+	return err
+}
+
+// Serve accepts connections from net.Listener and serves each in a goroutine
+func (p *TransparentProxy) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go p.ServeConn(conn)
+	}
+}
+
+// ServeConn forwards a captured TCP connection to its original destination
+func (p *TransparentProxy) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	var target net.Addr
+	if p.TPROXY {
+		target = conn.LocalAddr()
+	} else {
+		var err error
+		if target, err = OriginalDestination(conn); err != nil {
+			return err
+		}
+	}
+	rconn, err := p.Dialer.DialContext(context.Background(), "tcp", target.String())
+	if err != nil {
+		return err
+	}
+	defer rconn.Close()
+	_, _, err = Relay(conn, rconn)
+	return err
+}
+
+// ServePacket forwards captured datagrams to their original destinations, returns when c is closed
+// replies are sent from sockets bound to original destinations, so the client sees expected source
+func (p *TransparentProxy) ServePacket(c *net.UDPConn) error {
+	timeout := p.UDPTimeout
+	if timeout == 0 {
+		timeout = DefaultUDPTimeout
+	}
+
+	var lock sync.Mutex
+	sessions := map[string]net.PacketConn{}
+	defer func() {
+		lock.Lock()
+		for _, rc := range sessions {
+			rc.Close()
+		}
+		lock.Unlock()
+	}()
+
+	buf := make([]byte, PacketMaxSize)
+	for {
+		n, client, dst, err := ReadFromOriginalDestination(c, buf)
+		if err != nil {
+			if _, ok := err.(net.Error); ok {
+				return err
+			}
+			continue
+		}
+		lock.Lock()
+		rc := sessions[client.String()]
+		if rc == nil {
+			if rc, err = p.Dialer.ListenPacket(context.Background()); err != nil {
+				lock.Unlock()
+				continue
+			}
+			sessions[client.String()] = rc
+			go func(client *net.UDPAddr, rc net.PacketConn) {
+				p.relayPacket(client, rc, timeout)
+				lock.Lock()
+				delete(sessions, client.String())
+				lock.Unlock()
+				rc.Close()
+			}(client, rc)
+		}
+		lock.Unlock()
+		rc.SetReadDeadline(time.Now().Add(timeout))
+		rc.WriteTo(buf[:n], dst)
+	}
+}
+
+// relayPacket relays replies of targets to client, from sockets bound to target addresses
+func (p *TransparentProxy) relayPacket(client *net.UDPAddr, rc net.PacketConn, timeout time.Duration) {
+	// reply sockets by source address
+	replies := map[string]net.PacketConn{}
+	defer func() {
+		for _, c := range replies {
+			c.Close()
+		}
+	}()
+
+	buf := make([]byte, PacketMaxSize)
+	for {
+		rc.SetReadDeadline(time.Now().Add(timeout))
+		n, src, err := rc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		c := replies[src.String()]
+		if c == nil {
+			addr, err := net.ResolveUDPAddr("udp", src.String())
+			if err != nil {
+				continue
+			}
+			if c, err = DialTransparentPacket(addr); err != nil {
+				continue
+			}
+			replies[src.String()] = c
+		}
+		c.WriteTo(buf[:n], client)
+	}
+}
@@ -0,0 +1,188 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// socket options missing from syscall package
+const (
+	// SO_ORIGINAL_DST, linux/netfilter_ipv4.h
+	soOriginalDst = 80
+	// IP6T_SO_ORIGINAL_DST, linux/netfilter_ipv6/ip6_tables.h
+	ip6tSoOriginalDst = 80
+	// IPV6_TRANSPARENT, linux/in6.h
+	ipv6Transparent = 75
+	// IPV6_RECVORIGDSTADDR and IPV6_ORIGDSTADDR, linux/in6.h
+	ipv6RecvOrigDstAddr = 74
+	ipv6OrigDstAddr     = 74
+)
+
+// ErrNoOriginalDestination original destination is not found
+var ErrNoOriginalDestination = errors.New("original destination not found")
+
+// OriginalDestination returns original destination of a TCP connection redirected by iptables REDIRECT
+func OriginalDestination(conn net.Conn) (net.Addr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, ErrNoOriginalDestination
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	ipv6 := tc.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+
+	var addr *net.TCPAddr
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if ipv6 {
+			// sockaddr_in6 fits in ip6_mtuinfo
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, ip6tSoOriginalDst)
+			if err != nil {
+				serr = err
+				return
+			}
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			addr = &net.TCPAddr{
+				IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+				Port: int(port[0])<<8 | int(port[1]),
+			}
+			return
+		}
+		// sockaddr_in fits in ipv6_mreq
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+		if err != nil {
+			serr = err
+			return
+		}
+		b := mreq.Multiaddr
+		addr = &net.TCPAddr{
+			IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+			Port: int(b[2])<<8 | int(b[3]),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, serr
+	}
+	return addr, nil
+}
+
+// setTransparent set IP_TRANSPARENT, and IP_RECVORIGDSTADDR if recv is true
+// IPv6 options are set as well, errors are ignored for IPv4 sockets
+func setTransparent(c syscall.RawConn, recv bool) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); serr != nil {
+			return
+		}
+		syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		if recv {
+			if serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1); serr != nil {
+				return
+			}
+			syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// ListenTransparent listens TCP with IP_TRANSPARENT for TPROXY, requires CAP_NET_ADMIN
+func ListenTransparent(address string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setTransparent(c, false)
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// ListenTransparentPacket listens UDP with IP_TRANSPARENT and IP_RECVORIGDSTADDR for TPROXY, requires CAP_NET_ADMIN
+func ListenTransparentPacket(address string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setTransparent(c, true)
+		},
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// DialTransparentPacket create a UDP socket bound to a non-local address, for replying TPROXY clients
+func DialTransparentPacket(src *net.UDPAddr) (net.PacketConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+			})
+			if err != nil {
+				return err
+			}
+			if serr != nil {
+				return serr
+			}
+			return setTransparent(c, false)
+		},
+	}
+	return lc.ListenPacket(context.Background(), "udp", src.String())
+}
+
+// ReadFromOriginalDestination reads a datagram from socket created by ListenTransparentPacket
+// returns source and original destination
+func ReadFromOriginalDestination(c *net.UDPConn, b []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	oob := make([]byte, 1024)
+	n, oobn, _, src, err := c.ReadMsgUDP(b, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	dst, err := parseOriginalDestination(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return n, src, dst, nil
+}
+
+// parseOriginalDestination extracts IP_ORIGDSTADDR or IPV6_ORIGDSTADDR from socket control messages
+func parseOriginalDestination(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		b := msg.Data
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_ORIGDSTADDR:
+			// sockaddr_in: family(2) port(2) addr(4)
+			if len(b) < 8 {
+				continue
+			}
+			return &net.UDPAddr{
+				IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+				Port: int(b[2])<<8 | int(b[3]),
+			}, nil
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == ipv6OrigDstAddr:
+			// sockaddr_in6: family(2) port(2) flowinfo(4) addr(16) scope_id(4)
+			if len(b) < 24 {
+				continue
+			}
+			return &net.UDPAddr{
+				IP:   append(net.IP(nil), b[8:24]...),
+				Port: int(b[2])<<8 | int(b[3]),
+			}, nil
+		}
+	}
+	return nil, ErrNoOriginalDestination
+}
@@ -0,0 +1,56 @@
+package core
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestParseOriginalDestination(t *testing.T) {
+	// IP_ORIGDSTADDR with sockaddr_in of 10.0.0.1:53
+	data := []byte{syscall.AF_INET, 0, 0, 53, 10, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}
+	oob := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = syscall.SOL_IP
+	h.Type = syscall.IP_ORIGDSTADDR
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(oob[syscall.CmsgLen(0):], data)
+
+	addr, err := parseOriginalDestination(oob)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if addr.String() != "10.0.0.1:53" {
+		t.Fatalf("Bad address: %v", addr)
+	}
+
+	if _, err = parseOriginalDestination(nil); err != ErrNoOriginalDestination {
+		t.Fatal("Should fail without IP_ORIGDSTADDR")
+	}
+}
+
+func TestListenTransparentPacket(t *testing.T) {
+	c, err := ListenTransparentPacket("127.0.0.1:0")
+	if err != nil {
+		// requires CAP_NET_ADMIN
+		t.Skipf("Cannot listen transparent: %v", err)
+	}
+	defer c.Close()
+
+	client, err := net.Dial("udp", c.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Cannot dial: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("hello world!"))
+
+	buf := make([]byte, PacketMaxSize)
+	n, src, dst, err := ReadFromOriginalDestination(c, buf)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if string(buf[:n]) != "hello world!" || src.String() != client.LocalAddr().String() || dst.String() != c.LocalAddr().String() {
+		t.Fatalf("Bad datagram: %q from %v to %v", buf[:n], src, dst)
+	}
+}
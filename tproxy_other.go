@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+package core
+
+import (
+	"net"
+)
+
+// ErrNoOriginalDestination original destination is not found
+var ErrNoOriginalDestination = ErrTransparentNotSupported
+
+// OriginalDestination is only supported on Linux
+func OriginalDestination(conn net.Conn) (net.Addr, error) {
+	return nil, ErrTransparentNotSupported
+}
+
+// ListenTransparent is only supported on Linux
+func ListenTransparent(address string) (net.Listener, error) {
+	return nil, ErrTransparentNotSupported
+}
+
+// ListenTransparentPacket is only supported on Linux
+func ListenTransparentPacket(address string) (*net.UDPConn, error) {
+	return nil, ErrTransparentNotSupported
+}
+
+// DialTransparentPacket is only supported on Linux
+func DialTransparentPacket(src *net.UDPAddr) (net.PacketConn, error) {
+	return nil, ErrTransparentNotSupported
+}
+
+// ReadFromOriginalDestination is only supported on Linux
+func ReadFromOriginalDestination(c *net.UDPConn, b []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	return 0, nil, nil, ErrTransparentNotSupported
+}
@@ -0,0 +1,51 @@
+package core
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+const tproxyServerAddr = ":12322"
+const tproxyEchoAddr = ":12323"
+
+// capturedConn pretends to be a connection captured by TPROXY
+type capturedConn struct {
+	net.Conn
+	local net.Addr
+}
+
+func (c *capturedConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func TestTransparentProxyTPROXY(t *testing.T) {
+	config, _ := ParseConfigFromURL("flee://hello@127.0.0.1" + tproxyServerAddr)
+	c, _ := config.NewCipher()
+
+	echo := startTestEchoServer(t, tproxyEchoAddr)
+	defer echo.Close()
+	fl, fp := startTestFleeServer(t, tproxyServerAddr, c)
+	defer fl.Close()
+	defer fp.Close()
+
+	p, err := NewTransparentProxy(config, true)
+	if err != nil {
+		t.Fatalf("Cannot create TransparentProxy: %v", err)
+	}
+
+	left, right := net.Pipe()
+	defer left.Close()
+	local, _ := net.ResolveTCPAddr("tcp", "127.0.0.1"+tproxyEchoAddr)
+	go p.ServeConn(&capturedConn{Conn: right, local: local})
+
+	str := randomPayloadString()
+	go left.Write([]byte(str))
+	res := make([]byte, len(str))
+	if _, err = io.ReadFull(left, res); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if string(res) != str {
+		t.Fatal("Str mismatch")
+	}
+}
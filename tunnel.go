@@ -0,0 +1,131 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrMissingForward forward address is not specified
+var ErrMissingForward = errors.New("forward address is not specified")
+
+// Tunnel forwards local TCP connections and UDP datagrams to a fixed target through ProxyDialer
+type Tunnel struct {
+	// dialer for target, usually a *Dialer
+	Dialer ProxyDialer
+	// fixed target host:port
+	Target string
+	// idle timeout of UDP associations
+	UDPTimeout time.Duration
+}
+
+// NewTunnel create a new Tunnel forwarding to Config.Forward through FleeGrid server of Config
+func NewTunnel(config *Config) (*Tunnel, error) {
+	if len(config.Forward) == 0 {
+		return nil, ErrMissingForward
+	}
+	d, err := NewDialer(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Tunnel{Dialer: d, Target: config.Forward}, nil
+}
+
+// ListenAndServe listens on address for both TCP and UDP, and serves
+func (t *Tunnel) ListenAndServe(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	go t.ServePacket(pc)
+	err = t.Serve(l)
+	pc.Close()
+	return err
+}
+
+// Serve accepts connections from net.Listener and serves each in a goroutine
+func (t *Tunnel) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go t.ServeConn(conn)
+	}
+}
+
+// ServeConn forwards a TCP connection to target, closes it when finished
+func (t *Tunnel) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	rconn, err := t.Dialer.DialContext(context.Background(), "tcp", t.Target)
+	if err != nil {
+		return err
+	}
+	defer rconn.Close()
+	_, _, err = Relay(conn, rconn)
+	return err
+}
+
+// ServePacket forwards datagrams from each local client to target, returns when pc is closed
+func (t *Tunnel) ServePacket(pc net.PacketConn) error {
+	target, err := ParseAddr(t.Target)
+	if err != nil {
+		return err
+	}
+	timeout := t.UDPTimeout
+	if timeout == 0 {
+		timeout = DefaultUDPTimeout
+	}
+
+	var lock sync.Mutex
+	sessions := map[string]net.PacketConn{}
+	defer func() {
+		lock.Lock()
+		for _, rc := range sessions {
+			rc.Close()
+		}
+		lock.Unlock()
+	}()
+
+	buf := make([]byte, PacketMaxSize)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		rc := sessions[client.String()]
+		if rc == nil {
+			if rc, err = t.Dialer.ListenPacket(context.Background()); err != nil {
+				lock.Unlock()
+				continue
+			}
+			sessions[client.String()] = rc
+			go func(client net.Addr, rc net.PacketConn) {
+				b := make([]byte, PacketMaxSize)
+				for {
+					rc.SetReadDeadline(time.Now().Add(timeout))
+					n, _, err := rc.ReadFrom(b)
+					if err != nil {
+						break
+					}
+					pc.WriteTo(b[:n], client)
+				}
+				lock.Lock()
+				delete(sessions, client.String())
+				lock.Unlock()
+				rc.Close()
+			}(client, rc)
+		}
+		lock.Unlock()
+		rc.SetReadDeadline(time.Now().Add(timeout))
+		rc.WriteTo(buf[:n], target)
+	}
+}
@@ -0,0 +1,78 @@
+package core
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const tunnelAddr = ":12319"
+const tunnelServerAddr = ":12320"
+const tunnelEchoAddr = ":12321"
+
+func TestTunnel(t *testing.T) {
+	config, err := ParseConfigFromURL("flee://hello@127.0.0.1" + tunnelServerAddr + "?forward=127.0.0.1" + tunnelEchoAddr)
+	if err != nil {
+		t.Fatalf("Cannot parse config: %v", err)
+	}
+	c, _ := config.NewCipher()
+
+	echo := startTestEchoServer(t, tunnelEchoAddr)
+	defer echo.Close()
+	fl, fp := startTestFleeServer(t, tunnelServerAddr, c)
+	defer fl.Close()
+	defer fp.Close()
+
+	tn, err := NewTunnel(config)
+	if err != nil {
+		t.Fatalf("Cannot create Tunnel: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1"+tunnelAddr)
+	if err != nil {
+		t.Fatalf("Cannot listen socket: %v", err)
+	}
+	defer l.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1"+tunnelAddr)
+	if err != nil {
+		t.Fatalf("Cannot listen socket: %v", err)
+	}
+	defer pc.Close()
+	go tn.Serve(l)
+	go tn.ServePacket(pc)
+
+	// TCP
+	conn, err := net.Dial("tcp", "127.0.0.1"+tunnelAddr)
+	if err != nil {
+		t.Fatal("Cannot dial socket")
+	}
+	defer conn.Close()
+	str := randomPayloadString()
+	go conn.Write([]byte(str))
+	res := make([]byte, len(str))
+	if _, err = io.ReadFull(conn, res); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if string(res) != str {
+		t.Fatal("Str mismatch")
+	}
+
+	// UDP, test FleeGrid server echoes packets
+	uconn, err := net.Dial("udp", "127.0.0.1"+tunnelAddr)
+	if err != nil {
+		t.Fatal("Cannot dial socket")
+	}
+	defer uconn.Close()
+	uconn.Write([]byte("hello world!"))
+	uconn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := uconn.Read(res)
+	if err != nil || string(res[:n]) != "hello world!" {
+		t.Fatalf("Failed to read UDP: %v", err)
+	}
+
+	// missing forward
+	config.Forward = ""
+	if _, err = NewTunnel(config); err != ErrMissingForward {
+		t.Fatal("Should fail without forward")
+	}
+}
@@ -0,0 +1,480 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"log"
+)
+
+var (
+	// ErrHandshakeFailed key exchange message can not be authenticated
+	ErrHandshakeFailed = errors.New("handshake authentication failed")
+	// ErrMissingServerKey server only knows public key of itself
+	ErrMissingServerKey = errors.New("private key of server is not set")
+)
+
+// ServerKeyEncoding encoding of server keys in config
+var ServerKeyEncoding = base64.RawURLEncoding
+
+// HKDF info of keys derived by X25519Cipher
+var (
+	x25519ClientHelloInfo = []byte("fleegrid-x25519 client hello")
+	x25519ServerHelloInfo = []byte("fleegrid-x25519 server hello")
+	x25519ClientInfo      = []byte("fleegrid-x25519 client to server")
+	x25519ServerInfo      = []byte("fleegrid-x25519 server to client")
+	x25519SessionInfo     = []byte("fleegrid-x25519 session")
+	sessionRekeyInfo      = []byte("fleegrid session rekey")
+)
+
+// HandshakeCipher is implemented by ciphers exchanging keys before any data, like X25519Cipher
+//
+// StreamConn initializes both directions by Handshake on first Read or Write, StreamConn created by
+// NewServerStreamConn or NewMultiUserStreamConn is the server, otherwise the client.
+// A failed or interrupted handshake can not be retried. CreateAEAD is still used for packets.
+type HandshakeCipher interface {
+	Cipher
+	// size of the first message sent by client
+	HelloSize() int
+	// authenticate the first message sent by client, for identifying users
+	VerifyHello(hello []byte) bool
+	// exchange keys over rw, returns AEADs for writing and reading, and Cipher for rekeying
+	Handshake(rw io.ReadWriter, client bool) (w, r cipher.AEAD, session Cipher, err error)
+}
+
+// ServerKeyCipher is implemented by ciphers authenticating server with a static key, like X25519Cipher
+type ServerKeyCipher interface {
+	Cipher
+	// create a copy of cipher pinning public key of server, for clients
+	WithServerPublicKey(pub []byte) (Cipher, error)
+	// create a copy of cipher holding private key of server, for servers
+	WithServerPrivateKey(priv []byte) (Cipher, error)
+}
+
+// X25519Cipher is a forward-secret cipher for streams
+// ephemeral X25519 public keys are exchanged and authenticated with the pre-shared key (like Noise NNpsk0),
+// traffic keys are derived from both the pre-shared key and the shared secret
+// with a static X25519 key of server pinned by clients, server is authenticated by the key as well (like Noise NKpsk0),
+// so holders of the pre-shared key can not impersonate the server
+// hybrid variants mix a shared key of ML-KEM-768 encapsulated by server as well, against harvest-now-decrypt-later
+// packets are not forward-secret, they are encrypted by the base cipher
+type X25519Cipher struct {
+	// base cipher for packets
+	Cipher
+	name    string
+	key     *masterKey
+	newAEAD func(key []byte) (cipher.AEAD, error)
+	// static key of server, dropped by Destroy, guarded by key
+	serverKey    *ecdh.PrivateKey
+	serverPublic *ecdh.PublicKey
+	// hybrid with ML-KEM-768
+	mlkem bool
+}
+
+// NewX25519ChapoCipher create a X25519Cipher with ChaCha20-Poly1305
+func NewX25519ChapoCipher(key []byte, size int) (Cipher, error) {
+	return newX25519Cipher("FLEE_X25519_CHACHA20_POLY1305", key, size, false, NewChapoCipher, chacha20poly1305.New)
+}
+
+// NewX25519AESGCMCipher create a X25519Cipher with AES-256-GCM
+func NewX25519AESGCMCipher(key []byte, size int) (Cipher, error) {
+	return newX25519Cipher("FLEE_X25519_AES_256_GCM", key, size, false, NewAESGCMCipher, newGCM)
+}
+
+// NewX25519MLKEMChapoCipher create a hybrid X25519Cipher with ML-KEM-768 and ChaCha20-Poly1305
+func NewX25519MLKEMChapoCipher(key []byte, size int) (Cipher, error) {
+	return newX25519Cipher("FLEE_X25519_MLKEM768_CHACHA20_POLY1305", key, size, true, NewChapoCipher, chacha20poly1305.New)
+}
+
+// NewX25519MLKEMAESGCMCipher create a hybrid X25519Cipher with ML-KEM-768 and AES-256-GCM
+func NewX25519MLKEMAESGCMCipher(key []byte, size int) (Cipher, error) {
+	return newX25519Cipher("FLEE_X25519_MLKEM768_AES_256_GCM", key, size, true, NewAESGCMCipher, newGCM)
+}
+
+func newX25519Cipher(name string, key []byte, size int, hybrid bool, base func([]byte, int) (Cipher, error), newAEAD func([]byte) (cipher.AEAD, error)) (Cipher, error) {
+	if size != 32 {
+		return nil, BadKeyLengthError(size)
+	}
+	// base cipher has its own copy of key, so both can be destroyed
+	bk := copyKey(key)
+	b, err := base(bk, size)
+	if err != nil {
+		destroyKey(bk)
+		return nil, err
+	}
+	return &X25519Cipher{Cipher: b, name: name, key: &masterKey{b: key}, newAEAD: newAEAD, mlkem: hybrid}, nil
+}
+
+// newGCM create AES-GCM AEAD with key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blk)
+}
+
+// WithHKDF for X25519Cipher, only subkeys of packets are affected
+func (c *X25519Cipher) WithHKDF(k *HKDF) Cipher {
+	ret := *c
+	ret.key = c.key.copy()
+	if hc, ok := c.Cipher.(HKDFCipher); ok {
+		ret.Cipher = hc.WithHKDF(k)
+	} else {
+		ret.Cipher = cloneCipher(c.Cipher)
+	}
+	return &ret
+}
+
+func (c *X25519Cipher) clone() Cipher {
+	ret := *c
+	ret.key = c.key.copy()
+	ret.Cipher = cloneCipher(c.Cipher)
+	return &ret
+}
+
+// Destroy for X25519Cipher, zeroes pre-shared key, static key of server is dropped but can not be zeroed
+func (c *X25519Cipher) Destroy() {
+	DestroyCipher(c.Cipher)
+	c.key.Lock()
+	defer c.key.Unlock()
+	destroyKey(c.key.b)
+	c.key.b, c.serverKey = nil, nil
+}
+
+// WithServerPublicKey for X25519Cipher
+func (c *X25519Cipher) WithServerPublicKey(pub []byte) (Cipher, error) {
+	k, err := ecdh.X25519().NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	ret := c.clone().(*X25519Cipher)
+	ret.serverKey, ret.serverPublic = nil, k
+	return ret, nil
+}
+
+// WithServerPrivateKey for X25519Cipher
+func (c *X25519Cipher) WithServerPrivateKey(priv []byte) (Cipher, error) {
+	k, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	ret := c.clone().(*X25519Cipher)
+	ret.serverKey, ret.serverPublic = k, k.PublicKey()
+	return ret, nil
+}
+
+// GenerateServerKey generates a static X25519 key of server, encoded with ServerKeyEncoding
+func GenerateServerKey() (priv, pub string, err error) {
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return ServerKeyEncoding.EncodeToString(k.Bytes()), ServerKeyEncoding.EncodeToString(k.PublicKey().Bytes()), nil
+}
+
+// HelloSize for X25519Cipher, ephemeral public key, encapsulation key of ML-KEM if hybrid, and tag
+func (c *X25519Cipher) HelloSize() int {
+	if c.mlkem {
+		return 32 + mlkem.EncapsulationKeySize768 + 16
+	}
+	return 32 + 16
+}
+
+// replySize ephemeral public key, ciphertext of ML-KEM if hybrid, and tag
+func (c *X25519Cipher) replySize() int {
+	if c.mlkem {
+		return 32 + mlkem.CiphertextSize768 + 16
+	}
+	return 32 + 16
+}
+
+// VerifyHello for X25519Cipher
+func (c *X25519Cipher) VerifyHello(hello []byte) bool {
+	if len(hello) != c.HelloSize() {
+		return false
+	}
+	payload := hello[:len(hello)-16]
+	return c.key.use(func(key []byte) error {
+		return c.open(hkdfExpand(key, hello[:32], x25519ClientHelloInfo), hello[len(payload):], payload)
+	}) == nil
+}
+
+// Handshake for X25519Cipher
+func (c *X25519Cipher) Handshake(rw io.ReadWriter, client bool) (cipher.AEAD, cipher.AEAD, Cipher, error) {
+	if client {
+		return c.clientHandshake(rw)
+	}
+	return c.serverHandshake(rw)
+}
+
+func (c *X25519Cipher) clientHandshake(rw io.ReadWriter) (cipher.AEAD, cipher.AEAD, Cipher, error) {
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var dk *mlkem.DecapsulationKey768
+	if c.mlkem {
+		if dk, err = mlkem.GenerateKey768(); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	hello, err := c.clientHello(e, dk)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if _, err = rw.Write(hello); err != nil {
+		return nil, nil, nil, err
+	}
+	reply := make([]byte, c.replySize())
+	if _, err = io.ReadFull(rw, reply); err != nil {
+		return nil, nil, nil, err
+	}
+	prk, err := c.clientFinish(hello, reply, e, dk)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer zeroBytes(prk)
+	return c.trafficKeys(prk, true)
+}
+
+func (c *X25519Cipher) serverHandshake(rw io.ReadWriter) (cipher.AEAD, cipher.AEAD, Cipher, error) {
+	hello := make([]byte, c.HelloSize())
+	if _, err := io.ReadFull(rw, hello); err != nil {
+		return nil, nil, nil, err
+	}
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	reply, prk, err := c.serverReply(hello, e, encapsulate768)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer zeroBytes(prk)
+	if _, err = rw.Write(reply); err != nil {
+		return nil, nil, nil, err
+	}
+	return c.trafficKeys(prk, false)
+}
+
+// encapsulate768 generates a shared key and its ciphertext with ML-KEM-768
+func encapsulate768(ek *mlkem.EncapsulationKey768) ([]byte, []byte, error) {
+	shared, ct := ek.Encapsulate()
+	return shared, ct, nil
+}
+
+// clientHello returns hello with ephemeral keys of client, dk is nil unless hybrid
+func (c *X25519Cipher) clientHello(e *ecdh.PrivateKey, dk *mlkem.DecapsulationKey768) ([]byte, error) {
+	payload := e.PublicKey().Bytes()
+	if c.mlkem {
+		payload = append(payload, dk.EncapsulationKey().Bytes()...)
+	}
+	var hello []byte
+	err := c.key.use(func(key []byte) (err error) {
+		hello, err = c.seal(hkdfExpand(key, payload[:32], x25519ClientHelloInfo), payload, payload)
+		return
+	})
+	return hello, err
+}
+
+// serverReply verifies hello, returns reply with ephemeral keys of server and pseudorandom key of handshake
+func (c *X25519Cipher) serverReply(hello []byte, e *ecdh.PrivateKey, encapsulate func(*mlkem.EncapsulationKey768) ([]byte, []byte, error)) ([]byte, []byte, error) {
+	if !c.VerifyHello(hello) {
+		return nil, nil, ErrHandshakeFailed
+	}
+	peer, err := ecdh.X25519().NewPublicKey(hello[:32])
+	if err != nil {
+		return nil, nil, ErrHandshakeFailed
+	}
+	payload := e.PublicKey().Bytes()
+	var shared []byte
+	if c.mlkem {
+		ek, err := mlkem.NewEncapsulationKey768(hello[32 : len(hello)-16])
+		if err != nil {
+			return nil, nil, ErrHandshakeFailed
+		}
+		var ct []byte
+		if shared, ct, err = encapsulate(ek); err != nil {
+			return nil, nil, err
+		}
+		payload = append(payload, ct...)
+	}
+	transcript := c.transcript(hello[:len(hello)-16], payload)
+	prk, err := c.handshakeSecret(e, peer, shared, transcript, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	reply, err := c.seal(hkdfExpand(prk, nil, x25519ServerHelloInfo), payload, transcript)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reply, prk, nil
+}
+
+// clientFinish verifies reply, returns pseudorandom key of handshake
+func (c *X25519Cipher) clientFinish(hello, reply []byte, e *ecdh.PrivateKey, dk *mlkem.DecapsulationKey768) ([]byte, error) {
+	if len(reply) != c.replySize() {
+		return nil, ErrHandshakeFailed
+	}
+	peer, err := ecdh.X25519().NewPublicKey(reply[:32])
+	if err != nil {
+		return nil, ErrHandshakeFailed
+	}
+	payload := reply[:len(reply)-16]
+	var shared []byte
+	if c.mlkem {
+		if shared, err = dk.Decapsulate(payload[32:]); err != nil {
+			return nil, ErrHandshakeFailed
+		}
+	}
+	transcript := c.transcript(hello[:len(hello)-16], payload)
+	prk, err := c.handshakeSecret(e, peer, shared, transcript, true)
+	if err != nil {
+		return nil, err
+	}
+	if c.open(hkdfExpand(prk, nil, x25519ServerHelloInfo), reply[len(payload):], transcript) != nil {
+		return nil, ErrHandshakeFailed
+	}
+	return prk, nil
+}
+
+// transcript of handshake, payloads of hello and reply, and static public key of server if any
+func (c *X25519Cipher) transcript(hello, reply []byte) []byte {
+	t := append(append([]byte{}, hello...), reply...)
+	if c.serverPublic != nil {
+		t = append(t, c.serverPublic.Bytes()...)
+	}
+	return t
+}
+
+// handshakeSecret derives pseudorandom key of handshake from pre-shared key and shared secrets
+// kem is the shared key of ML-KEM if hybrid, otherwise nil
+func (c *X25519Cipher) handshakeSecret(e *ecdh.PrivateKey, peer *ecdh.PublicKey, kem, transcript []byte, client bool) ([]byte, error) {
+	var prk []byte
+	err := c.key.use(func(key []byte) error {
+		if !client && c.serverPublic != nil && c.serverKey == nil {
+			return ErrMissingServerKey
+		}
+		shared, err := e.ECDH(peer)
+		if err != nil {
+			return ErrHandshakeFailed
+		}
+		// capacity for all secrets, appending never copies key elsewhere
+		ikm := append(append(make([]byte, 0, len(key)+2*len(shared)+len(kem)), key...), shared...)
+		defer func() { zeroBytes(ikm) }()
+		zeroBytes(shared)
+		if c.serverPublic != nil {
+			// only the holder of private key of server agrees on this
+			if client {
+				shared, err = e.ECDH(c.serverPublic)
+			} else {
+				shared, err = c.serverKey.ECDH(peer)
+			}
+			if err != nil {
+				return ErrHandshakeFailed
+			}
+			ikm = append(ikm, shared...)
+			zeroBytes(shared)
+		}
+		ikm = append(ikm, kem...)
+		prk = hkdf.Extract(sha256.New, ikm, transcript)
+		return nil
+	})
+	return prk, err
+}
+
+// trafficKeys derives AEADs for writing and reading, and session Cipher for rekeying
+func (c *X25519Cipher) trafficKeys(prk []byte, client bool) (cipher.AEAD, cipher.AEAD, Cipher, error) {
+	w, err := newAEADOnce(c.newAEAD, hkdfExpand(prk, nil, x25519ClientInfo))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r, err := newAEADOnce(c.newAEAD, hkdfExpand(prk, nil, x25519ServerInfo))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !client {
+		w, r = r, w
+	}
+	session := &sessionCipher{secret: hkdfExpand(prk, nil, x25519SessionInfo), newAEAD: c.newAEAD, nonceSize: w.NonceSize()}
+	return w, r, session, nil
+}
+
+// seal appends tag of additional data to prefix, with a single use key
+func (c *X25519Cipher) seal(key, prefix, data []byte) ([]byte, error) {
+	a, err := newAEADOnce(c.newAEAD, key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, a.NonceSize())
+	return a.Seal(append([]byte{}, prefix...), nonce, nil, data), nil
+}
+
+// open verifies tag of additional data, with a single use key
+func (c *X25519Cipher) open(key, tag, data []byte) error {
+	a, err := newAEADOnce(c.newAEAD, key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, a.NonceSize())
+	_, err = a.Open(nil, nonce, tag, data)
+	return err
+}
+
+// newAEADOnce create AEAD with a single use key, and zeroes the key
+func newAEADOnce(newAEAD func(key []byte) (cipher.AEAD, error), key []byte) (cipher.AEAD, error) {
+	defer zeroBytes(key)
+	return newAEAD(key)
+}
+
+// hkdfExpand derives a 32 bytes key with HKDF_SHA256, nil salt skips extraction for secret already pseudorandom
+func hkdfExpand(secret, salt, info []byte) []byte {
+	var r io.Reader
+	if salt == nil {
+		r = hkdf.Expand(sha256.New, secret, info)
+	} else {
+		r = hkdf.New(sha256.New, secret, salt, info)
+	}
+	out := make([]byte, 32)
+	if _, err := io.ReadFull(r, out); err != nil {
+		// should never happened
+		log.Fatal(err)
+	}
+	return out
+}
+
+// sessionCipher derives subkeys from a secret agreed by handshake, for rekeying streams
+type sessionCipher struct {
+	secret    []byte
+	newAEAD   func(key []byte) (cipher.AEAD, error)
+	nonceSize int
+}
+
+// KeySize for sessionCipher
+func (c *sessionCipher) KeySize() int {
+	return 32
+}
+
+// SaltSize for sessionCipher
+func (c *sessionCipher) SaltSize() int {
+	return 32
+}
+
+// NonceSize for sessionCipher
+func (c *sessionCipher) NonceSize() int {
+	return c.nonceSize
+}
+
+// CreateAEAD for sessionCipher
+func (c *sessionCipher) CreateAEAD(salt []byte) (cipher.AEAD, error) {
+	return newAEADOnce(c.newAEAD, hkdfExpand(c.secret, salt, sessionRekeyInfo))
+}